@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// alertMethods Actions an Alert rule can take when its alert fires
+var alertMethods = map[string]bool{
+	"restartworker": true,
+	"scaleto":       true,
+	"scaleby":       true,
+	"pausemonitor":  true,
+	"scaleasg":      true,
+	"webhook":       true,
+}
+
+// alertData Values available to an Alert rule's templates
+type alertData struct {
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+// compileTemplates - Parse the templated fields of an Alert, panicking on invalid config.
+func compileTemplates(a Alert) map[string]*template.Template {
+	fields := map[string]string{
+		"deisapp": a.DeisApp,
+		"worker":  a.Worker,
+		"monitor": a.Monitor,
+		"asg":     a.ASG,
+		"url":     a.URL,
+	}
+	out := map[string]*template.Template{}
+	for name, text := range fields {
+		t, err := template.New(name).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			logger.Panic("Invalid alert template", "monitor", a.Name, "field", name, "err", err)
+		}
+		out[name] = t
+	}
+	return out
+}
+
+// render - Value of a templated field for an alert, an error when it renders empty.
+func (r *alertRule) render(field string, alert amAlert) (string, error) {
+	var b bytes.Buffer
+	if err := r.templates[field].Execute(&b, alertData{Labels: alert.Labels, Annotations: alert.Annotations}); err != nil {
+		return "", err
+	}
+	v := strings.TrimSpace(b.String())
+	if v == "" {
+		return "", fmt.Errorf("%s is empty for alert %s", field, alert.Labels["alertname"])
+	}
+	return v, nil
+}
+
+// run - Carry out the rule's action for a firing alert.
+func (r *alertRule) run(alert amAlert) error {
+	reason := "alert " + alert.Labels["alertname"] + " firing"
+	switch r.Method {
+	case "restartworker", "scaleto", "scaleby":
+		app, err := r.render("deisapp", alert)
+		if err != nil {
+			return err
+		}
+		worker, err := r.render("worker", alert)
+		if err != nil {
+			return err
+		}
+		e := Event{Monitor: r.Name, Reason: reason, ReasonCode: reasonAlert}
+		if r.Method == "restartworker" {
+			if !startRestart(app, worker, func() { deisRestart(app, worker, r.Restart, e) }) {
+				// Act on the alert again once the running restart is done
+				r.forget(alert.key())
+				return fmt.Errorf("a restart of %s-%s is still running", app, worker)
+			}
+			return nil
+		}
+		counts, err := deisPodCounts(app)
+		if err != nil {
+			return err
+		}
+		e.OldReplicas = counts[worker]
+		desired := counts[worker] + r.By
+		if r.Method == "scaleto" {
+			desired = *r.Replicas
+		}
+		if desired < 0 {
+			desired = 0
+		}
+		deisScale(app, worker, desired, e)
+	case "pausemonitor":
+		name, err := r.render("monitor", alert)
+		if err != nil {
+			return err
+		}
+		if !monitorRegistered(name) {
+			return fmt.Errorf("unknown monitor %s", name)
+		}
+		if monitorDryRun(r.Name) {
+			recordEvent(Event{Type: "control", Monitor: r.Name, Reason: "pause " + name + ", " + reason, ReasonCode: reasonAlert}, true, nil)
+			return nil
+		}
+		setControl(name, func(c *MonitorControl) { c.Paused = true })
+		recordControl(name, "paused by "+reason)
+	case "scaleasg":
+		name, err := r.render("asg", alert)
+		if err != nil {
+			return err
+		}
+		asg := ASG{AsGroupName: name, AWSRegion: r.AWSRegion, Enabled: true}
+		for _, configured := range cfg.ASG {
+			if configured.AsGroupName == name {
+				asg = configured
+			}
+		}
+		c, err := getAutoScaleDesired(asg)
+		if err != nil {
+			return err
+		}
+		// In drain mode, decide on the capacity left once draining instances are gone
+		drain := asgDrainer(name)
+		if drain != nil {
+			c.Desired -= drain.pending()
+		}
+		desired := c.Desired + r.By
+		if r.By == 0 {
+			desired = *r.Replicas
+		}
+		desired = clampInt(desired, c.Min, c.Max)
+		if desired != c.Desired {
+			moveASG(asg, drain, c, desired, Event{Monitor: r.Name, ASG: name, OldReplicas: c.Desired, Reason: reason, ReasonCode: reasonAlert})
+		}
+	case "webhook":
+		return r.callWebhook(alert, reason)
+	}
+	return nil
+}
+
+// callWebhook - POST the alert and the rule that matched it as JSON to the rule's URL.
+func (r *alertRule) callWebhook(alert amAlert, reason string) error {
+	url, err := r.render("url", alert)
+	if err != nil {
+		return err
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"rule":        r.Name,
+		"labels":      alert.Labels,
+		"annotations": alert.Annotations,
+		"startsAt":    alert.StartsAt,
+		"fingerprint": alert.key(),
+	})
+	e := Event{Type: "webhook", Monitor: r.Name, Reason: reason, ReasonCode: reasonAlert}
+	if monitorDryRun(r.Name) {
+		recordEvent(e, true, nil)
+		return nil
+	}
+	start := time.Now()
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	observeCall("webhook", "post", start, err)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("webhook returned %s", resp.Status)
+		}
+	}
+	recordEvent(e, false, err)
+	return err
+}
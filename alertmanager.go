@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// amAlert Alert as returned by the Alertmanager v1 and v2 APIs
+type amAlert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    time.Time         `json:"startsAt"`
+	Fingerprint string            `json:"fingerprint"`
+	Status      struct {
+		// active, suppressed or unprocessed
+		State       string   `json:"state"`
+		SilencedBy  []string `json:"silencedBy"`
+		InhibitedBy []string `json:"inhibitedBy"`
+	} `json:"status"`
+}
+
+// suppressed - Whether the alert is silenced, inhibited or otherwise not active.
+func (a amAlert) suppressed() bool {
+	if len(a.Status.SilencedBy) > 0 || len(a.Status.InhibitedBy) > 0 {
+		return true
+	}
+	return a.Status.State != "" && a.Status.State != "active"
+}
+
+// fetchAlerts - Alerts of the Alertmanager at host, through API version "v1" or "v2".
+func fetchAlerts(host string, version string) ([]amAlert, error) {
+	path := "/api/v1/alerts/"
+	if version == "v2" {
+		path = "/api/v2/alerts?active=true&silenced=false&inhibited=false"
+	}
+	resp, err := http.Get(host + path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("alertmanager returned %s", resp.Status)
+	}
+
+	var alerts []amAlert
+	if version == "v2" {
+		err = json.Unmarshal(body, &alerts)
+	} else {
+		var v1 struct {
+			Data []amAlert `json:"data"`
+		}
+		err = json.Unmarshal(body, &v1)
+		alerts = v1.Data
+	}
+	return alerts, err
+}
+
+// labelMatcher Alertmanager style label matcher: name, one of = != =~ !~, value
+type labelMatcher struct {
+	name  string
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+// parseMatcher - Matcher from e.g. service="foo", service=~"foo|bar" or env!=dev.
+func parseMatcher(s string) (labelMatcher, error) {
+	i := strings.IndexAny(s, "=!")
+	if i <= 0 {
+		return labelMatcher{}, fmt.Errorf("invalid matcher %q", s)
+	}
+	m := labelMatcher{name: strings.TrimSpace(s[:i])}
+	rest := s[i:]
+	for _, op := range []string{"=~", "!~", "!=", "="} {
+		if strings.HasPrefix(rest, op) {
+			m.op, rest = op, rest[len(op):]
+			break
+		}
+	}
+	if m.op == "" {
+		return labelMatcher{}, fmt.Errorf("invalid matcher %q", s)
+	}
+	m.value = strings.TrimSpace(rest)
+	if strings.HasPrefix(m.value, `"`) {
+		v, err := strconv.Unquote(m.value)
+		if err != nil {
+			return labelMatcher{}, fmt.Errorf("invalid matcher value %q", s)
+		}
+		m.value = v
+	}
+	if m.op == "=~" || m.op == "!~" {
+		// Anchored like Alertmanager's regex matchers
+		re, err := regexp.Compile("^(?:" + m.value + ")$")
+		if err != nil {
+			return labelMatcher{}, fmt.Errorf("invalid matcher regex %q: %v", s, err)
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+func (m labelMatcher) matches(labels map[string]string) bool {
+	v := labels[m.name]
+	switch m.op {
+	case "=":
+		return v == m.value
+	case "!=":
+		return v != m.value
+	case "=~":
+		return m.re.MatchString(v)
+	}
+	return !m.re.MatchString(v)
+}
+
+// compileMatchers - Parse matchers of a monitor, panicking on invalid config.
+func compileMatchers(monitor string, matchers []string) []labelMatcher {
+	var out []labelMatcher
+	for _, s := range matchers {
+		m, err := parseMatcher(s)
+		if err != nil {
+			logger.Panic("Invalid alert matcher", "monitor", monitor, "err", err)
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+// matchAll - Whether labels satisfy every matcher.
+func matchAll(matchers []labelMatcher, labels map[string]string) bool {
+	for _, m := range matchers {
+		if !m.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+package main
+
+import "testing"
+
+func TestParseMatcher(t *testing.T) {
+	tests := []struct {
+		in      string
+		name    string
+		op      string
+		value   string
+		invalid bool
+	}{
+		{in: `alertname="ConsumerStalled"`, name: "alertname", op: "=", value: "ConsumerStalled"},
+		{in: `env!=dev`, name: "env", op: "!=", value: "dev"},
+		{in: ` service =~ "foo|bar" `, name: "service", op: "=~", value: "foo|bar"},
+		{in: `service!~"tmp-.*"`, name: "service", op: "!~", value: "tmp-.*"},
+		{in: `msg="a \"quoted\" value"`, name: "msg", op: "=", value: `a "quoted" value`},
+		{in: `empty=""`, name: "empty", op: "=", value: ""},
+		{in: `=value`, invalid: true},
+		{in: `novalue`, invalid: true},
+		{in: `name!value`, invalid: true},
+		{in: `name="unterminated`, invalid: true},
+		{in: `name=~"("`, invalid: true},
+	}
+	for _, tt := range tests {
+		m, err := parseMatcher(tt.in)
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("parseMatcher(%q) = %+v, want error", tt.in, m)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseMatcher(%q): %v", tt.in, err)
+			continue
+		}
+		if m.name != tt.name || m.op != tt.op || m.value != tt.value {
+			t.Errorf("parseMatcher(%q) = %s %s %q, want %s %s %q", tt.in, m.name, m.op, m.value, tt.name, tt.op, tt.value)
+		}
+	}
+}
+
+func TestMatcherMatches(t *testing.T) {
+	labels := map[string]string{"alertname": "ConsumerStalled", "service": "foobar", "env": "prod"}
+	tests := []struct {
+		matcher string
+		want    bool
+	}{
+		{`alertname="ConsumerStalled"`, true},
+		{`alertname="Consumer"`, false},
+		{`env!=dev`, true},
+		{`env!=prod`, false},
+		{`service=~"foo.*"`, true},
+		// Regexes are anchored
+		{`service=~"foo"`, false},
+		{`service=~"bar"`, false},
+		{`service!~"foo"`, true},
+		{`service!~"foo|foobar"`, false},
+		// Missing labels are empty
+		{`team=""`, true},
+		{`team=~".*"`, true},
+		{`team!=""`, false},
+	}
+	for _, tt := range tests {
+		m, err := parseMatcher(tt.matcher)
+		if err != nil {
+			t.Errorf("parseMatcher(%q): %v", tt.matcher, err)
+			continue
+		}
+		if got := m.matches(labels); got != tt.want {
+			t.Errorf("%s matches %v = %t, want %t", tt.matcher, labels, got, tt.want)
+		}
+	}
+}
@@ -1,67 +1,313 @@
 package main
 
 import (
-	"io/ioutil"
+	"encoding/json"
 	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
 	"time"
-
-	"github.com/buger/jsonparser"
 )
 
+// alertRules Alert monitors, matched against polled and webhook alerts
+var alertRules []*alertRule
+
 func alertRunner() {
 	alerts := cfg.Alerts
 	for _, alert := range alerts {
-		switch method := alert.Method; method {
-		case "restartworker":
-			go alertLookup(alert)
-		default:
-			Info.Println("Nothing to do")
+		if !alertMethods[alert.Method] {
+			logger.Warn("Alert Missing/Invalid Method", "monitor", alert.Name, "method", alert.Method)
+			continue
+		}
+		source := alert.AlertHost
+		if source == "" {
+			source = "webhook"
+		}
+		registerMonitor(MonitorStatus{
+			Name:   alert.Name,
+			Type:   "alert",
+			Method: alert.Method,
+			App:    alert.DeisApp,
+			Worker: alert.Worker,
+			Source: source,
+		})
+		checkAlertAction(alert)
+		configureDryRun(alert.Name, alert.DryRun)
+		rule := newAlertRule(alert)
+		alertRules = append(alertRules, rule)
+		// Without an Alertmanager to poll the rule is only fed by the webhook
+		if alert.AlertHost != "" {
+			registerDependency("alertmanager", alert.AlertHost)
+			go alertLookup(rule)
 		}
 	}
 }
 
-func checkforRabbitStats(body []byte) (stats string) {
-	//looks for an alert called RabbitMQStatZero if this is true mark stats as down so puppeteer doesn't restart pods
-	stats = "up"
-	jsonparser.ArrayEach(body, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
-		active, err := jsonparser.GetString(value, "labels", "alertname")
-		if active == "RabbitMQStatsZero" {
-			stats = "down"
+// checkAlertAction - Panic unless the Alert sets how far its scale method scales.
+//
+// A missing replicas would otherwise scale the worker to zero, or the ASG to its min.
+func checkAlertAction(a Alert) {
+	switch {
+	case a.Method == "scaleto" && (a.Replicas == nil || *a.Replicas < 0):
+		logger.Panic("Alert scaleto needs replicas >= 0", "monitor", a.Name)
+	case a.Method == "scaleby" && a.By == 0:
+		logger.Panic("Alert scaleby needs a non-zero by", "monitor", a.Name)
+	case a.Method == "scaleasg" && a.By == 0 && (a.Replicas == nil || *a.Replicas < 0):
+		logger.Panic("Alert scaleasg needs replicas >= 0 or a non-zero by", "monitor", a.Name)
+	}
+}
+
+// log - Logger carrying the Alert monitor's context, at its LogLevel.
+func (a Alert) log() *Logger {
+	return logger.With("monitor", a.Name, "app", a.DeisApp, "worker", a.Worker).WithLevel(a.LogLevel)
+}
+
+// matchers - Label matchers of the Alert, alertname equal to its Name when none are set.
+func (a Alert) matchers() []labelMatcher {
+	if len(a.Matchers) == 0 {
+		return []labelMatcher{{name: "alertname", op: "=", value: a.Name}}
+	}
+	return compileMatchers(a.Name, a.Matchers)
+}
+
+// key - Alert fingerprint, or its sorted labels when Alertmanager sent none.
+func (a amAlert) key() string {
+	if a.Fingerprint != "" {
+		return a.Fingerprint
+	}
+	var pairs []string
+	for k, v := range a.Labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// alertRule Alert monitor and the firing alerts it already acted on
+//
+// Every alert is acted on once per fingerprint, however often it is polled or
+// notified, until it resolves.
+type alertRule struct {
+	Alert
+	matchers  []labelMatcher
+	templates map[string]*template.Template
+	mu        sync.Mutex
+	handled   map[string]time.Time
+	// Re-checks of webhook alerts not yet firing for For seconds
+	pending map[string]*time.Timer
+}
+
+func newAlertRule(a Alert) *alertRule {
+	return &alertRule{Alert: a, matchers: a.matchers(), templates: compileTemplates(a), handled: map[string]time.Time{}, pending: map[string]*time.Timer{}}
+}
+
+// matches - Whether the rule applies to an active alert that has been firing for For seconds.
+func (r *alertRule) matches(alert amAlert) bool {
+	if alert.suppressed() || !matchAll(r.matchers, alert.Labels) {
+		return false
+	}
+	if time.Since(alert.StartsAt) < time.Duration(r.For)*time.Second {
+		r.log().Debug("Alert firing, too recent", "alertname", alert.Labels["alertname"], "startsat", alert.StartsAt)
+		return false
+	}
+	return true
+}
+
+// dispatch - Act on a firing alert unless already done for its fingerprint.
+//
+// Alerts that can't be acted on now (paused, inhibited) are not
+// marked handled, so they are acted on once that clears. Returns whether an
+// action was started.
+func (r *alertRule) dispatch(alert amAlert) bool {
+	if !r.matches(alert) || r.blocked(alert) || r.restarting(alert) {
+		return false
+	}
+	r.mu.Lock()
+	_, seen := r.handled[alert.key()]
+	if !seen {
+		r.handled[alert.key()] = time.Now()
+	}
+	r.mu.Unlock()
+	if seen {
+		r.log().Debug("Alert already handled", "alertname", alert.Labels["alertname"], "fingerprint", alert.key())
+		return false
+	}
+	go r.act(alert)
+	return true
+}
+
+// recheck - Dispatch an alert again once it has been firing for For seconds.
+//
+// Alertmanager only pushes an alert when it starts and then every
+// repeat_interval, so one that arrives too recent would otherwise wait that long.
+func (r *alertRule) recheck(alert amAlert) {
+	if alert.suppressed() || !matchAll(r.matchers, alert.Labels) {
+		return
+	}
+	wait := time.Until(alert.StartsAt.Add(time.Duration(r.For) * time.Second))
+	if wait <= 0 {
+		return
+	}
+	key := alert.key()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.pending[key]; ok {
+		return
+	}
+	r.pending[key] = time.AfterFunc(wait, func() {
+		r.mu.Lock()
+		delete(r.pending, key)
+		r.mu.Unlock()
+		r.dispatch(alert)
+	})
+}
+
+// restarting - Whether the worker a restartworker rule would restart for the alert is already restarting.
+//
+// Alerts with several series, e.g. one per pod, would otherwise start a
+// restart each. The alert isn't marked handled, so it is acted on afterwards.
+func (r *alertRule) restarting(alert amAlert) bool {
+	if r.Method != "restartworker" {
+		return false
+	}
+	app, err := r.render("deisapp", alert)
+	if err != nil {
+		return false
+	}
+	worker, err := r.render("worker", alert)
+	if err != nil || !restartRunning(app, worker) {
+		return false
+	}
+	r.log().Info("Alert firing, restart still running, not acting", "alertname", alert.Labels["alertname"], "app", app, "worker", worker)
+	monitorDecided(r.Name, "firing, restart in progress")
+	return true
+}
+
+// forget - Stop treating an alert as handled, so it is acted on when next seen.
+func (r *alertRule) forget(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.handled, key)
+}
+
+// resolve - Forget a resolved alert, so it is acted on again if it fires again.
+func (r *alertRule) resolve(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.handled, key)
+	if t, ok := r.pending[key]; ok {
+		t.Stop()
+		delete(r.pending, key)
+	}
+}
+
+// keep - Forget every handled alert but the ones still firing.
+func (r *alertRule) keep(firing map[string]bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key := range r.handled {
+		if !firing[key] {
+			delete(r.handled, key)
 		}
-	}, "data")
-	return stats
+	}
+}
+
+// blocked - Whether nothing may be done about a firing alert right now.
+func (r *alertRule) blocked(alert amAlert) bool {
+	log := r.log()
+	name := alert.Labels["alertname"]
+	switch {
+	case monitorPaused(r.Name):
+		log.Info("Alert firing, paused, not acting", "alertname", name)
+		monitorDecided(r.Name, "firing, paused")
+	case inhibitedDecision(r.Name, log):
+	default:
+		return false
+	}
+	return true
 }
 
-func alertLookup(a Alert) {
+// act - Take the rule's action for a firing alert.
+func (r *alertRule) act(alert amAlert) {
+	log := r.log()
+	name := alert.Labels["alertname"]
+	log.Info("Alert firing, acting", "alertname", name, "method", r.Method, "fingerprint", alert.key())
+	monitorDecided(r.Name, r.Method)
+	if err := r.run(alert); err != nil {
+		log.Error("Alert action failed", "alertname", name, "method", r.Method, "err", err)
+		monitorDecided(r.Name, r.Method+" failed")
+	}
+}
+
+func alertLookup(r *alertRule) {
+	log := r.log()
 	for {
-		resp, err := http.Get(a.AlertHost + "/api/v1/alerts/")
+		start := time.Now()
+		alerts, err := fetchAlerts(r.AlertHost, r.API)
+		externalCall("alertmanager", r.AlertHost, "get_alerts", start, err)
+		monitorPolled(r.Name, 0, 0, err)
 		if err != nil {
-			Warning.Println(err)
-		}
-		body, _ := ioutil.ReadAll(resp.Body)
-		stats := checkforRabbitStats(body)
-
-		if stats == "down" {
-			Warning.Println("Stat is down, not restarting")
-			time.Sleep(150 * time.Second)
-		} else {
-			//loop over json returned from alertmanager API, drill down into data, labels, alertname
-			jsonparser.ArrayEach(body, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
-				active, err := jsonparser.GetString(value, "labels", "alertname")
-				if err != nil {
-					Warning.Println(err)
-				}
-				if active == a.Name {
-					if cfg.Enabled {
-						Info.Printf("Restarting %s %s", a.DeisApp, a.Worker)
-						deisRestart(a.DeisApp, a.Worker)
-						time.Sleep(120 * time.Second)
-					} else {
-						Warning.Println("Status disabled, not restarting")
-					}
-				}
-			}, "data") //top level json that contains the list of alerts
+			log.Error("Alertmanager lookup failed", "err", err)
 			time.Sleep(60 * time.Second)
+			continue
+		}
+		log.Debug("Polled alerts", "alerts", len(alerts))
+
+		firing := map[string]bool{}
+		for _, alert := range alerts {
+			if r.matches(alert) {
+				firing[alert.key()] = true
+				r.dispatch(alert)
+			}
+		}
+		r.keep(firing)
+		if len(firing) == 0 {
+			monitorDecided(r.Name, "not firing")
+		}
+		time.Sleep(60 * time.Second)
+	}
+}
+
+// webhookAlert Alert as sent by Alertmanager's webhook receiver
+type webhookAlert struct {
+	// firing or resolved
+	Status      string            `json:"status"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    time.Time         `json:"startsAt"`
+	Fingerprint string            `json:"fingerprint"`
+}
+
+// AlertWebhook Alertmanager webhook receiver, dispatching firing alerts to Alert rules
+func AlertWebhook(w http.ResponseWriter, r *http.Request) {
+	var msg struct {
+		Alerts []webhookAlert `json:"alerts"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		http.Error(w, "invalid webhook payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	dispatched := 0
+	for _, wa := range msg.Alerts {
+		alert := amAlert{Labels: wa.Labels, Annotations: wa.Annotations, StartsAt: wa.StartsAt, Fingerprint: wa.Fingerprint}
+		alert.Status.State = "active"
+		notifyInhibits(alert, wa.Status == "firing")
+		for _, rule := range alertRules {
+			if wa.Status == "resolved" {
+				rule.resolve(alert.key())
+				continue
+			}
+			if rule.AlertHost == "" {
+				monitorPolled(rule.Name, 0, 0, nil)
+			}
+			if rule.dispatch(alert) {
+				dispatched++
+			} else {
+				rule.recheck(alert)
+			}
 		}
 	}
+	logger.Debug("Alert webhook received", "alerts", len(msg.Alerts), "dispatched", dispatched)
+	writeJSON(w, map[string]int{"received": len(msg.Alerts), "dispatched": dispatched})
 }
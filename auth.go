@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// AuthConfig HTTP API Authentication Settings
+type AuthConfig struct {
+	// Require at least the read role on every endpoint but the open ones
+	Enabled bool
+	// File of "<role> <token>" lines, role is read or operator
+	TokensFile string
+	// Leave /metrics and health probes unauthenticated
+	OpenMetrics bool
+	OpenHealth  bool
+	// Serve HTTPS, and verify client certificates against ClientCA (mTLS)
+	TLSCert  string
+	TLSKey   string
+	ClientCA string
+	// Client certificate common names granted the operator role
+	OperatorCNs []string
+}
+
+// role Access level granted to a request
+type role int
+
+const (
+	roleNone role = iota
+	roleRead
+	roleOperator
+)
+
+func parseRole(s string) role {
+	switch strings.ToLower(s) {
+	case "read", "readonly", "read-only":
+		return roleRead
+	case "operator":
+		return roleOperator
+	}
+	return roleNone
+}
+
+// Authenticator Maps bearer tokens and client certificates to roles
+type Authenticator struct {
+	enabled     bool
+	tokens      map[string]role
+	operatorCNs map[string]bool
+}
+
+var auth *Authenticator
+
+// NewAuthenticator - Load tokens from env and the tokens file.
+//
+// PUPPETEER_READ_TOKENS and PUPPETEER_OPERATOR_TOKENS hold comma separated
+// tokens, PUPPETEER_CONTROL_TOKEN is kept as an operator token.
+func NewAuthenticator(c AuthConfig) *Authenticator {
+	a := &Authenticator{
+		enabled:     c.Enabled,
+		tokens:      map[string]role{},
+		operatorCNs: map[string]bool{},
+	}
+	for _, t := range strings.Split(os.Getenv("PUPPETEER_READ_TOKENS"), ",") {
+		a.addToken(t, roleRead)
+	}
+	for _, t := range strings.Split(os.Getenv("PUPPETEER_OPERATOR_TOKENS"), ",") {
+		a.addToken(t, roleOperator)
+	}
+	a.addToken(os.Getenv("PUPPETEER_CONTROL_TOKEN"), roleOperator)
+
+	if c.TokensFile != "" {
+		f, err := os.Open(c.TokensFile)
+		if err != nil {
+			logger.Panic("Unable to Read Tokens file", "file", c.TokensFile, "err", err)
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			fields := strings.Fields(line)
+			if len(fields) != 2 || parseRole(fields[0]) == roleNone {
+				logger.Warn("Ignoring invalid line in tokens file", "file", c.TokensFile)
+				continue
+			}
+			a.addToken(fields[1], parseRole(fields[0]))
+		}
+	}
+	for _, cn := range c.OperatorCNs {
+		a.operatorCNs[cn] = true
+	}
+	return a
+}
+
+func (a *Authenticator) addToken(token string, r role) {
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return
+	}
+	if r > a.tokens[token] {
+		a.tokens[token] = r
+	}
+}
+
+// roleOf - Highest role granted by the request's bearer token or client certificate.
+func (a *Authenticator) roleOf(r *http.Request) role {
+	granted := roleNone
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		granted = a.tokens[strings.TrimPrefix(h, "Bearer ")]
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		certRole := roleRead
+		if a.operatorCNs[r.TLS.PeerCertificates[0].Subject.CommonName] {
+			certRole = roleOperator
+		}
+		if certRole > granted {
+			granted = certRole
+		}
+	}
+	return granted
+}
+
+// require - Wrap h so it is only served to requests with at least role min.
+//
+// With auth disabled read endpoints are open, operator endpoints still need a token.
+func (a *Authenticator) require(min role, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if min == roleRead && !a.enabled {
+			h(w, r)
+			return
+		}
+		granted := a.roleOf(r)
+		if granted == roleNone {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if granted < min {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// reader - Require the read role.
+func (a *Authenticator) reader(h http.HandlerFunc) http.HandlerFunc {
+	return a.require(roleRead, h)
+}
+
+// operator - Require the operator role.
+func (a *Authenticator) operator(h http.HandlerFunc) http.HandlerFunc {
+	return a.require(roleOperator, h)
+}
+
+// open - Serve h unauthenticated when open is set, otherwise require the read role.
+func (a *Authenticator) open(open bool, h http.HandlerFunc) http.HandlerFunc {
+	if open {
+		return h
+	}
+	return a.reader(h)
+}
+
+// listenAndServe - Serve HTTP, or HTTPS with optional client certificates when TLS is configured.
+func listenAndServe(addr string, c AuthConfig, h http.Handler) error {
+	if c.TLSCert == "" {
+		return http.ListenAndServe(addr, h)
+	}
+	server := &http.Server{Addr: addr, Handler: h}
+	if c.ClientCA != "" {
+		pem, err := ioutil.ReadFile(c.ClientCA)
+		if err != nil {
+			logger.Panic("Unable to Read Client CA", "file", c.ClientCA, "err", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			logger.Panic("No certificates found in Client CA", "file", c.ClientCA)
+		}
+		server.TLSConfig = &tls.Config{
+			ClientCAs:  pool,
+			ClientAuth: tls.VerifyClientCertIfGiven,
+		}
+	}
+	return server.ListenAndServeTLS(c.TLSCert, c.TLSKey)
+}
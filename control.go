@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Override Pin a monitor to a fixed replica count until a deadline
+type Override struct {
+	Replicas int       `json:"replicas"`
+	Until    time.Time `json:"until"`
+}
+
+// MonitorControl Runtime state of a monitor, set through the control API
+type MonitorControl struct {
+	Paused bool `json:"paused"`
+	// Decide as usual, but only record what would have been done
+	DryRun   bool      `json:"dry_run"`
+	Override *Override `json:"override,omitempty"`
+}
+
+var (
+	controlMu sync.Mutex
+	controls  = map[string]*MonitorControl{}
+	// Global mode, starts from cfg.Enabled (STATE=enabled)
+	modeEnabled bool
+	modeSet     bool
+)
+
+// actionsEnabled - Whether Deis scale/restart actions are carried out.
+func actionsEnabled() bool {
+	controlMu.Lock()
+	defer controlMu.Unlock()
+	if !modeSet {
+		return cfg.Enabled
+	}
+	return modeEnabled
+}
+
+// monitorControl - Current runtime control of a monitor, expiring stale overrides.
+func monitorControl(name string) MonitorControl {
+	controlMu.Lock()
+	c, ok := controls[name]
+	if !ok {
+		controlMu.Unlock()
+		return MonitorControl{}
+	}
+	expired := c.Override != nil && time.Now().After(c.Override.Until)
+	if expired {
+		c.Override = nil
+	}
+	mc := *c
+	controlMu.Unlock()
+
+	if expired {
+		logger.Info("Override expired", "monitor", name)
+		recordControl(name, "override expired")
+	}
+	return mc
+}
+
+// monitorPaused - Whether a monitor has been paused through the control API.
+func monitorPaused(name string) bool {
+	return monitorControl(name).Paused
+}
+
+// monitorDryRun - Whether a monitor's actions are only recorded, globally or for the monitor.
+func monitorDryRun(name string) bool {
+	return !actionsEnabled() || monitorControl(name).DryRun
+}
+
+// asgDryRun - Whether changes to an ASG are only recorded.
+//
+// ASGs ignore the global mode, they have their own enabled switch: the group
+// is dry when its control says so, seeded from !enabled or dryrun at startup,
+// or when monitor, acting on the group on its behalf, is a dry-run monitor.
+func asgDryRun(asg string, monitor string) bool {
+	if monitorControl(asg).DryRun {
+		return true
+	}
+	return monitor != asg && monitorDryRun(monitor)
+}
+
+// configureDryRun - Start a monitor in dry-run mode when its config asks for it.
+func configureDryRun(name string, dryRun bool) {
+	if dryRun {
+		setControl(name, func(c *MonitorControl) { c.DryRun = true })
+	}
+}
+
+// monitorOverride - Pinned replica count of a monitor, if an override is active.
+func monitorOverride(name string) (int, bool) {
+	o := monitorControl(name).Override
+	if o == nil {
+		return 0, false
+	}
+	return o.Replicas, true
+}
+
+func setControl(name string, fn func(*MonitorControl)) {
+	controlMu.Lock()
+	defer controlMu.Unlock()
+	c, ok := controls[name]
+	if !ok {
+		c = &MonitorControl{}
+		controls[name] = c
+	}
+	fn(c)
+}
+
+// recordControl - Add a control API change to the event log.
+func recordControl(monitor string, reason string) {
+	eventLog.Record(Event{
+		Type:    "control",
+		Monitor: monitor,
+		Reason:  reason,
+		Result:  "success",
+	})
+}
+
+// lookupMonitor - Status board entry for the {name} in the request path.
+func lookupMonitor(w http.ResponseWriter, r *http.Request) (MonitorStatus, bool) {
+	name := mux.Vars(r)["name"]
+	statusMu.Lock()
+	s, ok := statusBoard[name]
+	statusMu.Unlock()
+	if !ok {
+		http.Error(w, "unknown monitor "+name, http.StatusNotFound)
+		return MonitorStatus{}, false
+	}
+	return *s, true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// SetMode Enable or disable actions globally, body {"enabled": bool}
+func SetMode(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	controlMu.Lock()
+	modeEnabled, modeSet = body.Enabled, true
+	controlMu.Unlock()
+
+	logger.Info("Global mode set", "enabled", body.Enabled)
+	recordControl("global", fmt.Sprintf("mode enabled=%t", body.Enabled))
+	writeJSON(w, body)
+}
+
+// PauseMonitor Stop a monitor from taking any action
+func PauseMonitor(w http.ResponseWriter, r *http.Request) {
+	m, ok := lookupMonitor(w, r)
+	if !ok {
+		return
+	}
+	setControl(m.Name, func(c *MonitorControl) { c.Paused = true })
+	logger.Info("Monitor paused", "monitor", m.Name)
+	recordControl(m.Name, "paused")
+	writeJSON(w, monitorControl(m.Name))
+}
+
+// ResumeMonitor Clear pause and override on a monitor
+func ResumeMonitor(w http.ResponseWriter, r *http.Request) {
+	m, ok := lookupMonitor(w, r)
+	if !ok {
+		return
+	}
+	setControl(m.Name, func(c *MonitorControl) {
+		c.Paused = false
+		c.Override = nil
+	})
+	logger.Info("Monitor resumed", "monitor", m.Name)
+	recordControl(m.Name, "resumed")
+	writeJSON(w, monitorControl(m.Name))
+}
+
+// DryRunMonitor Switch a monitor's dry-run mode, body {"enabled": bool}
+func DryRunMonitor(w http.ResponseWriter, r *http.Request) {
+	m, ok := lookupMonitor(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	setControl(m.Name, func(c *MonitorControl) { c.DryRun = body.Enabled })
+	logger.Info("Monitor dry-run set", "monitor", m.Name, "enabled", body.Enabled)
+	recordControl(m.Name, fmt.Sprintf("dry run %t", body.Enabled))
+	writeJSON(w, monitorControl(m.Name))
+}
+
+// OverrideMonitor Pin a monitor's replicas, body {"replicas": int, "minutes": int}
+func OverrideMonitor(w http.ResponseWriter, r *http.Request) {
+	m, ok := lookupMonitor(w, r)
+	if !ok {
+		return
+	}
+	if m.Type == "alert" || m.Type == "group" || m.Method == "restart" {
+		http.Error(w, "override only applies to scaling monitors", http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		Replicas int `json:"replicas"`
+		Minutes  int `json:"minutes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.Replicas < 0 || body.Minutes <= 0 {
+		http.Error(w, "replicas must be >= 0 and minutes > 0", http.StatusBadRequest)
+		return
+	}
+	o := &Override{
+		Replicas: body.Replicas,
+		Until:    time.Now().Add(time.Duration(body.Minutes) * time.Minute),
+	}
+	setControl(m.Name, func(c *MonitorControl) { c.Override = o })
+	logger.Info("Monitor overridden", "monitor", m.Name, "replicas", body.Replicas, "minutes", body.Minutes)
+	recordControl(m.Name, fmt.Sprintf("override to %d for %d minutes", body.Replicas, body.Minutes))
+	writeJSON(w, monitorControl(m.Name))
+}
+
+// RestartMonitor Restart a monitor's Deis worker now
+func RestartMonitor(w http.ResponseWriter, r *http.Request) {
+	m, ok := lookupMonitor(w, r)
+	if !ok {
+		return
+	}
+	if m.App == "" || m.Worker == "" {
+		http.Error(w, "monitor has no Deis app/worker to restart", http.StatusBadRequest)
+		return
+	}
+	logger.Info("Manual restart", "monitor", m.Name, "app", m.App, "worker", m.Worker)
+	e := Event{Monitor: m.Name, Signal: m.Depth, Reason: "manual restart", ReasonCode: reasonManual}
+	rc := restartConfigOf(m.Name)
+	// Restarts report their outcome through the event log
+	if !startRestart(m.App, m.Worker, func() { deisRestart(m.App, m.Worker, rc, e) }) {
+		http.Error(w, "a restart of "+m.App+"-"+m.Worker+" is still running", http.StatusConflict)
+		return
+	}
+	writeJSON(w, monitorControl(m.Name))
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// queueRecommendation - Pod count a scaling Queue monitor wants for messages, why, and its reason code.
+//
+// Returns podcount itself when no change is wanted.
+func queueRecommendation(q Queue, messages int, podcount int) (int, string, string) {
+	outside := podcount < q.ScaleMin || podcount > q.ScaleMax
+	switch {
+	case messages >= q.Threshold:
+		if outside {
+			return podcount, "over threshold, outside Min/Max", reasonOutOfRange
+		}
+		if podcount+q.ScaleBy > q.ScaleMax {
+			return q.ScaleMax, "over threshold, capped at ScaleMax", reasonOverThreshold
+		}
+		return podcount + q.ScaleBy, "over threshold", reasonOverThreshold
+	case messages < q.Watermark:
+		if podcount == q.ScaleMin {
+			return podcount, "under watermark, at ScaleMin", reasonUnderWatermark
+		}
+		if outside {
+			return podcount, "under watermark, outside Min/Max", reasonOutOfRange
+		}
+		d := podcount - q.scaleDownStep()
+		if d < q.ScaleMin {
+			return q.ScaleMin, "under watermark, capped at ScaleMin", reasonUnderWatermark
+		}
+		return d, "under watermark", reasonUnderWatermark
+	}
+	return podcount, "within threshold", reasonWithinThreshold
+}
+
+// scaleDownStep - Pods removed per scale-down.
+func (q Queue) scaleDownStep() int {
+	if q.ScaleDownBy > 0 {
+		return q.ScaleDownBy
+	}
+	return 1
+}
+
+// scaleUpStep - Instances added per scale-up.
+func (asg ASG) scaleUpStep() int {
+	if asg.ScaleUpBy > 0 {
+		return asg.ScaleUpBy
+	}
+	return scaleUpBy
+}
+
+// scaleDownStep - Instances removed per scale-down.
+func (asg ASG) scaleDownStep() int {
+	if asg.ScaleDownBy > 0 {
+		return asg.ScaleDownBy
+	}
+	return scaleDownBy
+}
+
+// asgRecommendation - Desired capacity an ASG monitor wants for messages, why, and its reason code.
+//
+// Returns the current desired capacity when no change is wanted.
+func asgRecommendation(asg ASG, c asgCapacity, messages int) (int, string, string) {
+	switch {
+	case messages < asg.Watermark:
+		d := c.Desired - asg.scaleDownStep()
+		if d < c.Min && c.Desired > c.Min {
+			return c.Min, "under watermark, capped at min", reasonUnderWatermark
+		} else if d >= c.Min {
+			return d, "under watermark", reasonUnderWatermark
+		}
+		return c.Desired, "under watermark, at min", reasonUnderWatermark
+	case messages >= asg.Threshold:
+		d := c.Desired + asg.scaleUpStep()
+		if d >= c.Max && c.Desired < c.Max {
+			return c.Max, "over threshold, capped at max", reasonOverThreshold
+		} else if d < c.Max {
+			return d, "over threshold", reasonOverThreshold
+		}
+		return c.Desired, "over threshold, at max", reasonOverThreshold
+	}
+	return c.Desired, "within threshold", reasonWithinThreshold
+}
+
+// clampInt - v bounded to lo..hi.
+func clampInt(v int, lo int, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+type recommendation struct {
+	at       time.Time
+	replicas int
+}
+
+// stabilizer Recent recommendations of a monitor, used to hold back scale-down
+//
+// Like the HPA scale-down stabilization window, a scale-down only goes as low as
+// the highest recommendation seen within the window, so a momentary dip below
+// the watermark after a burst doesn't remove capacity.
+type stabilizer struct {
+	window  time.Duration
+	history []recommendation
+}
+
+// newStabilizer - Stabilizer over a window of seconds, zero disables it.
+func newStabilizer(seconds int) *stabilizer {
+	return &stabilizer{window: time.Duration(seconds) * time.Second}
+}
+
+// stabilize - Record this poll's recommendation and return the stabilized one.
+//
+// Scale-ups and holds pass through unchanged, a scale-down below current is
+// raised to the highest recommendation within the window.
+func (s *stabilizer) stabilize(current int, desired int) int {
+	now := time.Now()
+	s.history = append(s.history, recommendation{at: now, replicas: desired})
+	kept := s.history[:0]
+	highest := desired
+	for _, r := range s.history {
+		if now.Sub(r.at) > s.window {
+			continue
+		}
+		kept = append(kept, r)
+		if r.replicas > highest {
+			highest = r.replicas
+		}
+	}
+	s.history = kept
+
+	if desired >= current {
+		return desired
+	}
+	if highest > current {
+		return current
+	}
+	return highest
+}
+
+// ScalePolicy Limit on how far a monitor may scale within a period
+type ScalePolicy struct {
+	// pods or percent
+	Type  string
+	Value int
+	// Seconds
+	Period int
+}
+
+// ScaleRules Rate limit policies for one scaling direction
+type ScaleRules struct {
+	Policies []ScalePolicy
+	// max (the policy allowing the largest change, default), min or disabled
+	Select string
+}
+
+type scaleChange struct {
+	at    time.Time
+	delta int
+}
+
+// rateLimiter Recent changes of a monitor, checked against its scale policies
+type rateLimiter struct {
+	up      ScaleRules
+	down    ScaleRules
+	history []scaleChange
+}
+
+func newRateLimiter(up ScaleRules, down ScaleRules) *rateLimiter {
+	return &rateLimiter{up: up, down: down}
+}
+
+// changedWithin - Sum of scale-ups and sum of scale-downs made in the last period.
+func (r *rateLimiter) changedWithin(period time.Duration) (int, int) {
+	var up, down int
+	now := time.Now()
+	for _, c := range r.history {
+		if now.Sub(c.at) > period {
+			continue
+		}
+		if c.delta > 0 {
+			up += c.delta
+		} else {
+			down -= c.delta
+		}
+	}
+	return up, down
+}
+
+// limit - Clamp desired to what the policies for its direction allow.
+//
+// Returns the allowed count and a description of the policy that clamped it,
+// empty when desired was allowed as is.
+func (r *rateLimiter) limit(current int, desired int) (int, string) {
+	if desired == current {
+		return desired, ""
+	}
+	rules, up := r.down, false
+	if desired > current {
+		rules, up = r.up, true
+	}
+	if rules.Select == "disabled" {
+		return current, "scaling disabled in this direction"
+	}
+	if len(rules.Policies) == 0 {
+		return desired, ""
+	}
+
+	var allowed int
+	var by string
+	for i, p := range rules.Policies {
+		upBy, downBy := r.changedWithin(time.Duration(p.Period) * time.Second)
+		var bound int
+		if up {
+			start := current - upBy
+			bound = start + p.Value
+			if p.Type == "percent" {
+				bound = start + (start*p.Value+99)/100
+			}
+		} else {
+			start := current + downBy
+			bound = start - p.Value
+			if p.Type == "percent" {
+				// floor(start * (1 - p)) like the HPA, so small counts can still lose a pod
+				bound = start - (start*p.Value+99)/100
+			}
+		}
+		// For scale-up the most permissive bound is the highest, for scale-down the lowest
+		permissive := (up && bound > allowed) || (!up && bound < allowed)
+		if i == 0 || permissive == (rules.Select != "min") {
+			allowed, by = bound, fmt.Sprintf("%s %d/%ds", p.Type, p.Value, p.Period)
+		}
+	}
+
+	if up && desired > allowed {
+		if allowed < current {
+			allowed = current
+		}
+		return allowed, by
+	}
+	if !up && desired < allowed {
+		if allowed > current {
+			allowed = current
+		}
+		return allowed, by
+	}
+	return desired, ""
+}
+
+// record - Remember a change made, dropping history older than any policy period.
+func (r *rateLimiter) record(delta int) {
+	now := time.Now()
+	var longest time.Duration
+	for _, p := range append(append([]ScalePolicy{}, r.up.Policies...), r.down.Policies...) {
+		if d := time.Duration(p.Period) * time.Second; d > longest {
+			longest = d
+		}
+	}
+	kept := r.history[:0]
+	for _, c := range r.history {
+		if now.Sub(c.at) <= longest {
+			kept = append(kept, c)
+		}
+	}
+	r.history = append(kept, scaleChange{at: now, delta: delta})
+}
+
+// rangeGuard Tracks how long a Queue monitor's pods have been outside ScaleMin..ScaleMax
+//
+// OutOfRange decides what happens then: ignore (default) leaves the count alone,
+// correct moves it back into range, respect leaves a manual change alone for
+// ManualGracePeriod seconds (forever when 0) before correcting it.
+type rangeGuard struct {
+	since time.Time
+}
+
+// correct - Pod count moving podcount back into range, and why.
+//
+// Returns podcount and an empty reason when in range or no correction is due.
+func (g *rangeGuard) correct(q Queue, podcount int) (int, string) {
+	bound := podcount
+	if podcount < q.ScaleMin {
+		bound = q.ScaleMin
+	} else if podcount > q.ScaleMax {
+		bound = q.ScaleMax
+	}
+	if bound == podcount {
+		g.since = time.Time{}
+		return podcount, ""
+	}
+	if g.since.IsZero() {
+		g.since = time.Now()
+	}
+
+	switch q.OutOfRange {
+	case "correct":
+	case "respect":
+		if q.ManualGracePeriod <= 0 || time.Since(g.since) < time.Duration(q.ManualGracePeriod)*time.Second {
+			return podcount, ""
+		}
+	default:
+		return podcount, ""
+	}
+
+	// Correction has its own step limit, independent of the scale policies
+	if step := q.OutOfRangeStep; step > 0 {
+		if bound > podcount+step {
+			bound = podcount + step
+		} else if bound < podcount-step {
+			bound = podcount - step
+		}
+	}
+	return bound, "outside Min/Max, correcting"
+}
+
+// IdleConfig Scale-to-zero Settings of a Queue monitor
+type IdleConfig struct {
+	Enabled bool
+	// Seconds the queue must be empty before scaling to zero, default 600
+	After int
+	// Pods started when a message arrives at zero, default ScaleMin (at least 1)
+	WarmCount int
+	// Seconds between polls while at zero, default 10
+	PollInterval int
+}
+
+// idleTracker How long a Queue monitor's queue has been empty
+type idleTracker struct {
+	emptySince time.Time
+}
+
+// decide - Scale to zero after an idle period, and wake on the first message.
+//
+// Returns the pod count and reason, and whether idle handling applies this poll.
+func (t *idleTracker) decide(q Queue, messages int, podcount int) (int, string, bool) {
+	if !q.Idle.Enabled {
+		return podcount, "", false
+	}
+	if messages > 0 {
+		t.emptySince = time.Time{}
+		if podcount == 0 {
+			return q.warmCount(), "wake from zero", true
+		}
+		return podcount, "", false
+	}
+	if t.emptySince.IsZero() {
+		t.emptySince = time.Now()
+	}
+	if podcount == 0 {
+		return 0, "idle at zero", true
+	}
+	after := q.Idle.After
+	if after <= 0 {
+		after = 600
+	}
+	if time.Since(t.emptySince) >= time.Duration(after)*time.Second {
+		return 0, "idle, scale to zero", true
+	}
+	return podcount, "", false
+}
+
+// warmCount - Pods started when waking from zero.
+func (q Queue) warmCount() int {
+	if q.Idle.WarmCount > 0 {
+		return q.Idle.WarmCount
+	}
+	if q.ScaleMin > 0 {
+		return q.ScaleMin
+	}
+	return 1
+}
+
+// pollInterval - Time until the next poll, shorter while idle at zero pods.
+func (q Queue) pollInterval(pods int) time.Duration {
+	if q.Idle.Enabled && pods == 0 {
+		if q.Idle.PollInterval > 0 {
+			return time.Duration(q.Idle.PollInterval) * time.Second
+		}
+		return 10 * time.Second
+	}
+	return 95 * time.Second
+}
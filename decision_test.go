@@ -0,0 +1,179 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStabilize(t *testing.T) {
+	tests := []struct {
+		name    string
+		window  int
+		history []int
+		current int
+		desired int
+		want    int
+	}{
+		{"scale up passes", 300, []int{8}, 4, 6, 6},
+		{"hold passes", 300, nil, 4, 4, 4},
+		{"disabled window", 0, []int{8}, 6, 2, 2},
+		{"down to highest in window", 300, []int{3, 5}, 6, 2, 5},
+		{"held at current", 300, []int{9}, 6, 2, 6},
+		{"down without history", 300, nil, 6, 2, 2},
+	}
+	for _, tt := range tests {
+		s := newStabilizer(tt.window)
+		for _, r := range tt.history {
+			s.history = append(s.history, recommendation{at: time.Now(), replicas: r})
+		}
+		if got := s.stabilize(tt.current, tt.desired); got != tt.want {
+			t.Errorf("%s: stabilize(%d, %d) = %d, want %d", tt.name, tt.current, tt.desired, got, tt.want)
+		}
+	}
+}
+
+func TestStabilizeForgetsOldRecommendations(t *testing.T) {
+	s := newStabilizer(60)
+	s.history = []recommendation{{at: time.Now().Add(-2 * time.Minute), replicas: 10}}
+	if got := s.stabilize(6, 2); got != 2 {
+		t.Errorf("stabilize(6, 2) = %d, want 2 once the old recommendation left the window", got)
+	}
+	if len(s.history) != 1 {
+		t.Errorf("history kept %d recommendations, want 1", len(s.history))
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	pods4 := ScalePolicy{Type: "pods", Value: 4, Period: 60}
+	tests := []struct {
+		name    string
+		up      ScaleRules
+		down    ScaleRules
+		history []int
+		current int
+		desired int
+		want    int
+		policy  string
+	}{
+		{"no policies", ScaleRules{}, ScaleRules{}, nil, 4, 20, 20, ""},
+		{"no change", ScaleRules{Policies: []ScalePolicy{pods4}}, ScaleRules{}, nil, 4, 4, 4, ""},
+		{"up disabled", ScaleRules{Select: "disabled"}, ScaleRules{}, nil, 4, 8, 4, "scaling disabled in this direction"},
+		{"up within pods", ScaleRules{Policies: []ScalePolicy{pods4}}, ScaleRules{}, nil, 4, 7, 7, ""},
+		{"up clamped by pods", ScaleRules{Policies: []ScalePolicy{pods4}}, ScaleRules{}, nil, 4, 10, 8, "pods 4/60s"},
+		{"up clamped by percent", ScaleRules{Policies: []ScalePolicy{{Type: "percent", Value: 50, Period: 60}}}, ScaleRules{}, nil, 10, 20, 15, "percent 50/60s"},
+		{"up counts recent changes", ScaleRules{Policies: []ScalePolicy{pods4}}, ScaleRules{}, []int{3}, 7, 10, 8, "pods 4/60s"},
+		{"up budget spent", ScaleRules{Policies: []ScalePolicy{pods4}}, ScaleRules{}, []int{5}, 9, 12, 9, "pods 4/60s"},
+		{"up select max", ScaleRules{Policies: []ScalePolicy{pods4, {Type: "percent", Value: 100, Period: 60}}}, ScaleRules{}, nil, 2, 10, 6, "pods 4/60s"},
+		{"up select min", ScaleRules{Policies: []ScalePolicy{pods4, {Type: "percent", Value: 100, Period: 60}}, Select: "min"}, ScaleRules{}, nil, 2, 10, 4, "percent 100/60s"},
+		{"down clamped by pods", ScaleRules{}, ScaleRules{Policies: []ScalePolicy{{Type: "pods", Value: 2, Period: 60}}}, nil, 10, 2, 8, "pods 2/60s"},
+		{"down clamped by percent", ScaleRules{}, ScaleRules{Policies: []ScalePolicy{{Type: "percent", Value: 50, Period: 60}}}, nil, 10, 2, 5, "percent 50/60s"},
+		{"down by percent at 9 pods", ScaleRules{}, ScaleRules{Policies: []ScalePolicy{{Type: "percent", Value: 10, Period: 300}}}, nil, 9, 3, 8, "percent 10/300s"},
+		{"down by percent at 5 pods", ScaleRules{}, ScaleRules{Policies: []ScalePolicy{{Type: "percent", Value: 10, Period: 300}}}, nil, 5, 3, 4, "percent 10/300s"},
+		{"down counts recent changes", ScaleRules{}, ScaleRules{Policies: []ScalePolicy{{Type: "pods", Value: 4, Period: 60}}}, []int{-3}, 7, 2, 6, "pods 4/60s"},
+		{"down ignores up policies", ScaleRules{Policies: []ScalePolicy{pods4}}, ScaleRules{}, nil, 10, 2, 2, ""},
+	}
+	for _, tt := range tests {
+		r := newRateLimiter(tt.up, tt.down)
+		for _, d := range tt.history {
+			r.history = append(r.history, scaleChange{at: time.Now(), delta: d})
+		}
+		got, policy := r.limit(tt.current, tt.desired)
+		if got != tt.want || policy != tt.policy {
+			t.Errorf("%s: limit(%d, %d) = %d, %q, want %d, %q", tt.name, tt.current, tt.desired, got, policy, tt.want, tt.policy)
+		}
+	}
+}
+
+func TestRateLimitForgetsChangesOutsidePeriod(t *testing.T) {
+	r := newRateLimiter(ScaleRules{Policies: []ScalePolicy{{Type: "pods", Value: 4, Period: 60}}}, ScaleRules{})
+	r.history = []scaleChange{{at: time.Now().Add(-2 * time.Minute), delta: 4}}
+	if got, _ := r.limit(8, 12); got != 12 {
+		t.Errorf("limit(8, 12) = %d, want 12 with the earlier change outside the period", got)
+	}
+	r.record(4)
+	if len(r.history) != 1 {
+		t.Errorf("record kept %d changes, want 1", len(r.history))
+	}
+}
+
+func TestRangeGuardCorrect(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       string
+		grace      int
+		step       int
+		outFor     time.Duration
+		podcount   int
+		want       int
+		wantReason bool
+	}{
+		{"in range", "correct", 0, 0, time.Hour, 4, 4, false},
+		{"ignore below min", "ignore", 0, 0, time.Hour, 1, 1, false},
+		{"correct below min", "correct", 0, 0, 0, 1, 2, true},
+		{"correct above max", "correct", 0, 0, 0, 12, 8, true},
+		{"correct limited by step", "correct", 0, 2, 0, 14, 12, true},
+		{"respect without grace", "respect", 0, 0, time.Hour, 12, 12, false},
+		{"respect within grace", "respect", 300, 0, time.Minute, 12, 12, false},
+		{"respect grace expired", "respect", 300, 0, 10 * time.Minute, 12, 8, true},
+		{"respect grace expired with step", "respect", 300, 1, 10 * time.Minute, 12, 11, true},
+	}
+	for _, tt := range tests {
+		q := Queue{ScaleMin: 2, ScaleMax: 8, OutOfRange: tt.mode, ManualGracePeriod: tt.grace, OutOfRangeStep: tt.step}
+		g := &rangeGuard{}
+		if tt.outFor > 0 {
+			g.since = time.Now().Add(-tt.outFor)
+		}
+		got, reason := g.correct(q, tt.podcount)
+		if got != tt.want || (reason != "") != tt.wantReason {
+			t.Errorf("%s: correct(%d) = %d, %q, want %d, reason %v", tt.name, tt.podcount, got, reason, tt.want, tt.wantReason)
+		}
+	}
+}
+
+func TestRangeGuardResetsInRange(t *testing.T) {
+	q := Queue{ScaleMin: 2, ScaleMax: 8, OutOfRange: "respect", ManualGracePeriod: 300}
+	g := &rangeGuard{since: time.Now().Add(-10 * time.Minute)}
+	g.correct(q, 4)
+	if !g.since.IsZero() {
+		t.Errorf("since = %v, want zero once back in range", g.since)
+	}
+	if got, _ := g.correct(q, 12); got != 12 {
+		t.Errorf("correct(12) = %d, want 12 with the grace period restarted", got)
+	}
+}
+
+func TestIdleDecide(t *testing.T) {
+	tests := []struct {
+		name      string
+		idle      IdleConfig
+		scaleMin  int
+		emptyFor  time.Duration
+		messages  int
+		podcount  int
+		want      int
+		reason    string
+		wantApply bool
+	}{
+		{"disabled", IdleConfig{}, 0, time.Hour, 0, 3, 3, "", false},
+		{"busy", IdleConfig{Enabled: true}, 0, 0, 5, 3, 3, "", false},
+		{"wake to warm count", IdleConfig{Enabled: true, WarmCount: 3}, 2, time.Hour, 5, 0, 3, "wake from zero", true},
+		{"wake to scale min", IdleConfig{Enabled: true}, 2, time.Hour, 5, 0, 2, "wake from zero", true},
+		{"wake to one", IdleConfig{Enabled: true}, 0, time.Hour, 5, 0, 1, "wake from zero", true},
+		{"idle at zero", IdleConfig{Enabled: true}, 0, time.Hour, 0, 0, 0, "idle at zero", true},
+		{"not idle long enough", IdleConfig{Enabled: true, After: 300}, 0, time.Minute, 0, 3, 3, "", false},
+		{"idle after", IdleConfig{Enabled: true, After: 300}, 0, 10 * time.Minute, 0, 3, 0, "idle, scale to zero", true},
+		{"idle after default", IdleConfig{Enabled: true}, 0, 5 * time.Minute, 0, 3, 3, "", false},
+		{"idle after default passed", IdleConfig{Enabled: true}, 0, 11 * time.Minute, 0, 3, 0, "idle, scale to zero", true},
+	}
+	for _, tt := range tests {
+		q := Queue{ScaleMin: tt.scaleMin, Idle: tt.idle}
+		i := &idleTracker{}
+		if tt.emptyFor > 0 {
+			i.emptySince = time.Now().Add(-tt.emptyFor)
+		}
+		got, reason, apply := i.decide(q, tt.messages, tt.podcount)
+		if got != tt.want || reason != tt.reason || apply != tt.wantApply {
+			t.Errorf("%s: decide(%d, %d) = %d, %q, %v, want %d, %q, %v", tt.name, tt.messages, tt.podcount, got, reason, apply, tt.want, tt.reason, tt.wantApply)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/external"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+)
+
+// ScaleInConfig How an ASG monitor removes instances
+//
+// In drain mode Puppeteer picks the instances itself, tells them to drain
+// through DrainURL, and only terminates them, decrementing desired capacity,
+// once DrainCheckURL reports them drained or DrainTimeout passes.
+type ScaleInConfig struct {
+	// desired (default) lowers desired capacity and lets AWS pick, or drain
+	Mode string
+	// POSTed {"asg", "instance_id", "action"} with action drain or cancel
+	DrainURL string
+	// Polled with ?instance_id=<id>, 200 once the instance is drained
+	DrainCheckURL string
+	// Seconds to wait for a drain before terminating anyway, default 600
+	DrainTimeout int
+	// Termination lifecycle hook completed with CONTINUE for terminated instances
+	LifecycleHook string
+}
+
+// drainTimeout - Time an instance gets to drain.
+func (c ScaleInConfig) drainTimeout() time.Duration {
+	if c.DrainTimeout > 0 {
+		return time.Duration(c.DrainTimeout) * time.Second
+	}
+	return 10 * time.Minute
+}
+
+// drainer Instances an ASG monitor is draining or terminating
+type drainer struct {
+	asg         ASG
+	mu          sync.Mutex
+	draining    map[string]time.Time
+	terminating map[string]bool
+}
+
+// Drain callbacks must not stall the ASG monitor loop
+var drainClient = &http.Client{Timeout: 10 * time.Second}
+
+var (
+	drainMu  sync.Mutex
+	drainers = map[string]*drainer{}
+)
+
+// newDrainer - Drainer of an ASG, registered so alert actions scale through it.
+func newDrainer(asg ASG) *drainer {
+	d := &drainer{asg: asg, draining: map[string]time.Time{}, terminating: map[string]bool{}}
+	drainMu.Lock()
+	drainers[asg.AsGroupName] = d
+	drainMu.Unlock()
+	return d
+}
+
+// asgDrainer - Drainer of an ASG monitor in drain mode, nil otherwise.
+func asgDrainer(name string) *drainer {
+	drainMu.Lock()
+	defer drainMu.Unlock()
+	return drainers[name]
+}
+
+// pending - Instances still counted in desired capacity but on their way out.
+func (d *drainer) pending() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.draining)
+}
+
+// drainingSince - Copy of the instances being drained.
+func (d *drainer) drainingSince() map[string]time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := map[string]time.Time{}
+	for id, since := range d.draining {
+		out[id] = since
+	}
+	return out
+}
+
+// moveASG - Scale an ASG to desired, through its drainer when it has one.
+//
+// c.Desired must already exclude the instances draining.
+func moveASG(asg ASG, drain *drainer, c asgCapacity, desired int, e Event) {
+	if drain != nil {
+		drain.apply(c, desired, e)
+		return
+	}
+	scaleASG(asg, desired, e)
+}
+
+func asgClient(asg ASG) *autoscaling.AutoScaling {
+	cfg, err := external.LoadDefaultAWSConfig()
+	if err != nil {
+		logger.Panic("Failed to load AWS config", "err", err)
+	}
+	cfg.Region = asg.AWSRegion
+	return autoscaling.New(cfg)
+}
+
+// pickScaleIn - Up to n in-service, unprotected instances not already draining.
+//
+// Like AWS's default termination policy, instances are taken from the
+// availability zone with the most instances first.
+func pickScaleIn(instances []autoscaling.Instance, skip map[string]time.Time, n int) []string {
+	perAZ := map[string][]string{}
+	for _, i := range instances {
+		if i.LifecycleState != autoscaling.LifecycleStateInService || (i.ProtectedFromScaleIn != nil && *i.ProtectedFromScaleIn) {
+			continue
+		}
+		if _, ok := skip[*i.InstanceId]; ok {
+			continue
+		}
+		perAZ[*i.AvailabilityZone] = append(perAZ[*i.AvailabilityZone], *i.InstanceId)
+	}
+	var azs []string
+	for az, ids := range perAZ {
+		sort.Strings(ids)
+		azs = append(azs, az)
+	}
+	sort.Strings(azs)
+
+	var picked []string
+	for len(picked) < n {
+		busiest := ""
+		for _, az := range azs {
+			if len(perAZ[az]) > 0 && (busiest == "" || len(perAZ[az]) > len(perAZ[busiest])) {
+				busiest = az
+			}
+		}
+		if busiest == "" {
+			break
+		}
+		ids := perAZ[busiest]
+		picked = append(picked, ids[len(ids)-1])
+		perAZ[busiest] = ids[:len(ids)-1]
+	}
+	return picked
+}
+
+// apply - Move the group to desired, draining instances instead of lowering desired capacity.
+//
+// c.Desired is the effective capacity, the group's desired capacity less the
+// instances draining. Scaling up cancels drains before adding instances.
+func (d *drainer) apply(c asgCapacity, desired int, e Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	log := d.asg.log()
+	if desired > c.Desired {
+		actual := c.Desired + len(d.draining)
+		dryRun := asgDryRun(d.asg.AsGroupName, e.Monitor)
+		// Each cancelled drain keeps one instance
+		var cancelled []string
+		for id := range d.draining {
+			if c.Desired >= desired {
+				break
+			}
+			cancelled = append(cancelled, id)
+			c.Desired++
+		}
+		if dryRun && len(cancelled) > 0 {
+			log.Info("Dry run, not cancelling drains", "instances", fmt.Sprint(cancelled), "desired", desired)
+		}
+		for _, id := range cancelled {
+			if !dryRun {
+				d.signal(id, "cancel")
+				delete(d.draining, id)
+				log.Info("Drain cancelled", "instance", id)
+			}
+		}
+		if desired > c.Desired {
+			// Instances still draining stay in desired capacity; scaleASG checks the dry run itself
+			e.OldReplicas = actual
+			scaleASG(d.asg, desired+actual-c.Desired, e)
+		} else {
+			e.Type, e.NewReplicas = "asg_scale", desired
+			e.Reason += ", cancelled drains"
+			recordEvent(e, dryRun, nil)
+			monitorDecided(d.asg.AsGroupName, e.Reason)
+		}
+		return
+	}
+
+	e.Type, e.NewReplicas = "asg_scale", desired
+	picked := pickScaleIn(c.Instances, d.draining, c.Desired-desired)
+	if len(picked) == 0 {
+		log.Warn("No instance can be drained, all protected or not in service", "desired", desired)
+		monitorDecided(d.asg.AsGroupName, "no instance to drain")
+		return
+	}
+	e.Reason += fmt.Sprintf(", draining %v", picked)
+	monitorDecided(d.asg.AsGroupName, fmt.Sprintf("drain %d to %d", len(picked), desired))
+	if asgDryRun(d.asg.AsGroupName, e.Monitor) {
+		log.Info("Dry run, not draining", "instances", fmt.Sprint(picked), "desired", desired)
+		recordEvent(e, true, nil)
+		return
+	}
+	for _, id := range picked {
+		d.signal(id, "drain")
+		d.draining[id] = time.Now()
+		log.Info("Draining instance", "instance", id)
+	}
+	recordEvent(e, false, nil)
+}
+
+// signal - Tell an instance through DrainURL to start or stop draining.
+func (d *drainer) signal(id string, action string) {
+	if d.asg.ScaleIn.DrainURL == "" {
+		return
+	}
+	start := time.Now()
+	err := postJSON(drainClient, d.asg.ScaleIn.DrainURL, map[string]string{"asg": d.asg.AsGroupName, "instance_id": id, "action": action})
+	observeCall("drain", action, start, err)
+	if err != nil {
+		d.asg.log().Warn("Drain callback failed", "instance", id, "action", action, "err", err)
+	}
+}
+
+// drained - Whether DrainCheckURL reports the instance drained.
+func (d *drainer) drained(id string) bool {
+	if d.asg.ScaleIn.DrainCheckURL == "" {
+		return false
+	}
+	start := time.Now()
+	resp, err := drainClient.Get(d.asg.ScaleIn.DrainCheckURL + "?instance_id=" + url.QueryEscape(id))
+	observeCall("drain", "check", start, err)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// progress - Terminate drained or timed out instances, and complete their lifecycle hook.
+//
+// Returns the number of instances terminated, each decrementing desired
+// capacity. Nothing is terminated or completed for a dry-run group.
+func (d *drainer) progress(c asgCapacity) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	log := d.asg.log()
+	if asgDryRun(d.asg.AsGroupName, d.asg.AsGroupName) {
+		if len(d.draining)+len(d.terminating) > 0 {
+			log.Info("Dry run, not terminating drained instances", "draining", len(d.draining))
+		}
+		return 0
+	}
+	states := map[string]autoscaling.LifecycleState{}
+	for _, i := range c.Instances {
+		states[*i.InstanceId] = i.LifecycleState
+	}
+	svc := asgClient(d.asg)
+	terminated := 0
+
+	for id := range d.terminating {
+		state, ok := states[id]
+		if !ok {
+			delete(d.terminating, id)
+			continue
+		}
+		if state == autoscaling.LifecycleStateTerminatingWait && d.asg.ScaleIn.LifecycleHook != "" {
+			result := "CONTINUE"
+			req := svc.CompleteLifecycleActionRequest(&autoscaling.CompleteLifecycleActionInput{
+				AutoScalingGroupName:  &d.asg.AsGroupName,
+				InstanceId:            &id,
+				LifecycleHookName:     &d.asg.ScaleIn.LifecycleHook,
+				LifecycleActionResult: &result,
+			})
+			start := time.Now()
+			_, err := req.Send()
+			externalCall("aws", d.asg.AWSRegion, "complete_lifecycle_action", start, err)
+			if err != nil {
+				log.Error("Completing lifecycle hook failed", "instance", id, "err", err)
+				continue
+			}
+			delete(d.terminating, id)
+		}
+	}
+
+	for id, since := range d.draining {
+		if _, ok := states[id]; !ok {
+			log.Warn("Draining instance left the group", "instance", id)
+			delete(d.draining, id)
+			continue
+		}
+		reason := "drained"
+		if !d.drained(id) {
+			if time.Since(since) < d.asg.ScaleIn.drainTimeout() {
+				continue
+			}
+			reason = "drain timed out"
+		}
+		decrement := true
+		req := svc.TerminateInstanceInAutoScalingGroupRequest(&autoscaling.TerminateInstanceInAutoScalingGroupInput{
+			InstanceId:                     &id,
+			ShouldDecrementDesiredCapacity: &decrement,
+		})
+		start := time.Now()
+		_, err := req.Send()
+		externalCall("aws", d.asg.AWSRegion, "terminate_instance", start, err)
+		e := Event{
+			Type:        "asg_terminate",
+			Monitor:     d.asg.AsGroupName,
+			ASG:         d.asg.AsGroupName,
+			OldReplicas: c.Desired,
+			NewReplicas: c.Desired - 1,
+			Reason:      reason + ", terminating " + id,
+			ReasonCode:  reasonTerminate,
+		}
+		recordEvent(e, false, err)
+		if err != nil {
+			log.Error("Terminating instance failed", "instance", id, "err", err)
+			continue
+		}
+		log.Info("Terminated instance", "instance", id, "reason", reason)
+		delete(d.draining, id)
+		d.terminating[id] = true
+		c.Desired--
+		terminated++
+	}
+	return terminated
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+)
+
+func instance(id string, az string) autoscaling.Instance {
+	return autoscaling.Instance{
+		InstanceId:       aws.String(id),
+		AvailabilityZone: aws.String(az),
+		LifecycleState:   autoscaling.LifecycleStateInService,
+	}
+}
+
+func TestPickScaleIn(t *testing.T) {
+	protected := instance("i-5", "us-east-1a")
+	protected.ProtectedFromScaleIn = aws.Bool(true)
+	pending := instance("i-6", "us-east-1a")
+	pending.LifecycleState = autoscaling.LifecycleStatePending
+
+	tests := []struct {
+		name      string
+		instances []autoscaling.Instance
+		skip      map[string]time.Time
+		n         int
+		want      []string
+	}{
+		{"none wanted", []autoscaling.Instance{instance("i-1", "us-east-1a")}, nil, 0, nil},
+		{"busiest az first", []autoscaling.Instance{
+			instance("i-1", "us-east-1a"), instance("i-2", "us-east-1b"), instance("i-3", "us-east-1b"),
+		}, nil, 1, []string{"i-3"}},
+		{"balances across azs", []autoscaling.Instance{
+			instance("i-1", "us-east-1a"), instance("i-2", "us-east-1a"), instance("i-3", "us-east-1a"),
+			instance("i-4", "us-east-1b"), instance("i-7", "us-east-1c"),
+		}, nil, 3, []string{"i-3", "i-2", "i-1"}},
+		{"ties go to the first az", []autoscaling.Instance{
+			instance("i-2", "us-east-1b"), instance("i-1", "us-east-1a"),
+		}, nil, 2, []string{"i-1", "i-2"}},
+		{"skips protected and not in service", []autoscaling.Instance{
+			protected, pending, instance("i-1", "us-east-1a"), instance("i-2", "us-east-1b"),
+		}, nil, 2, []string{"i-1", "i-2"}},
+		{"skips draining", []autoscaling.Instance{
+			instance("i-1", "us-east-1a"), instance("i-2", "us-east-1a"), instance("i-3", "us-east-1b"),
+		}, map[string]time.Time{"i-2": time.Now()}, 1, []string{"i-1"}},
+		{"fewer than wanted", []autoscaling.Instance{
+			instance("i-1", "us-east-1a"), protected,
+		}, nil, 3, []string{"i-1"}},
+	}
+	for _, tt := range tests {
+		if got := pickScaleIn(tt.instances, tt.skip, tt.n); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: pickScaleIn(%d) = %v, want %v", tt.name, tt.n, got, tt.want)
+		}
+	}
+}
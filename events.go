@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Event Record of a single scale, restart or ASG action
+type Event struct {
+	Time        time.Time `json:"time"`
+	Type        string    `json:"type"`
+	Monitor     string    `json:"monitor"`
+	App         string    `json:"app,omitempty"`
+	Worker      string    `json:"worker,omitempty"`
+	ASG         string    `json:"asg,omitempty"`
+	Signal      int       `json:"signal"`
+	OldReplicas int       `json:"old_replicas"`
+	NewReplicas int       `json:"new_replicas"`
+	Reason      string    `json:"reason"`
+	ReasonCode  string    `json:"reason_code"`
+	DryRun      bool      `json:"dry_run"`
+	Result      string    `json:"result"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// EventConfig Event Log Settings
+type EventConfig struct {
+	Size int
+	File string
+}
+
+// EventLog Bounded in-memory ring of Events, with optional file sink
+type EventLog struct {
+	mu     sync.Mutex
+	events []Event
+	next   int
+	full   bool
+	sink   *os.File
+}
+
+const defaultEventLogSize = 1000
+
+// NewEventLog - Create EventLog from config, opening the file sink if set.
+func NewEventLog(c EventConfig) *EventLog {
+	size := c.Size
+	if size <= 0 {
+		size = defaultEventLogSize
+	}
+	l := &EventLog{events: make([]Event, size)}
+	if c.File != "" {
+		f, err := os.OpenFile(c.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			logger.Warn("Unable to open event log file", "file", c.File, "err", err)
+		} else {
+			l.sink = f
+		}
+	}
+	return l
+}
+
+// Record - Store an Event, stamping the time if unset.
+func (l *EventLog) Record(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events[l.next] = e
+	l.next = (l.next + 1) % len(l.events)
+	if l.next == 0 {
+		l.full = true
+	}
+	if l.sink != nil {
+		line, _ := json.Marshal(e)
+		if _, err := l.sink.Write(append(line, '\n')); err != nil {
+			logger.Warn("Unable to write event log file", "err", err)
+		}
+	}
+}
+
+// List - Events oldest first, filtered by filter when non-nil.
+func (l *EventLog) List(filter func(Event) bool) []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var ordered []Event
+	if l.full {
+		ordered = append(ordered, l.events[l.next:]...)
+	}
+	ordered = append(ordered, l.events[:l.next]...)
+
+	out := []Event{}
+	for _, e := range ordered {
+		if filter == nil || filter(e) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+var eventLog *EventLog
+
+// recordEvent - Fill in outcome of an action and add it to the event log.
+func recordEvent(e Event, dryRun bool, err error) {
+	e.Time = time.Now()
+	e.DryRun = dryRun
+	if e.ReasonCode == "" {
+		e.ReasonCode = reasonOther
+	}
+	switch {
+	case dryRun:
+		e.Result = "dry_run"
+	case err != nil:
+		e.Result = "failed"
+		e.Error = err.Error()
+	default:
+		e.Result = "success"
+	}
+	promDecisions.With(prometheus.Labels{"monitor": e.Monitor, "direction": decisionDirection(e), "reason": e.ReasonCode, "dry_run": strconv.FormatBool(dryRun)}).Inc()
+	// Dry-run targets were never requested, so they stay out of the gauge
+	if !dryRun && (e.Type == "scale" || e.Type == "asg_scale") {
+		promReplicasDesired.With(prometheus.Labels{"monitor": e.Monitor}).Set(float64(e.NewReplicas))
+	}
+	eventLog.Record(e)
+	notifyEvent(e)
+}
+
+// Events List recorded events, filtered by app, worker, asg, monitor, type and limit
+func Events(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	app, worker, asg := q.Get("app"), q.Get("worker"), q.Get("asg")
+	monitor, etype := q.Get("monitor"), q.Get("type")
+
+	events := eventLog.List(func(e Event) bool {
+		return (app == "" || e.App == app) &&
+			(worker == "" || e.Worker == worker) &&
+			(asg == "" || e.ASG == asg) &&
+			(monitor == "" || e.Monitor == monitor) &&
+			(etype == "" || e.Type == etype)
+	})
+	if limit, err := strconv.Atoi(q.Get("limit")); err == nil && limit >= 0 && limit < len(events) {
+		events = events[len(events)-limit:]
+	}
+
+	writeJSON(w, events)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	rabbithole "github.com/michaelklishin/rabbit-hole"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ProcessGroup Queue monitors of one Deis app scaled together in one controller call
+type ProcessGroup struct {
+	Name    string
+	DeisApp string
+	// Process types sized relative to another, e.g. scheduler = cmd/10
+	Ratios []ProcessRatio
+	// Only record ratio changes
+	DryRun bool
+}
+
+// ProcessRatio Size Worker as Ratio times the target of Of, at least Min
+type ProcessRatio struct {
+	Worker string
+	Of     string
+	Ratio  float64
+	Min    int
+	Max    int
+}
+
+// target - Pods for the ratio's worker given the pod count of the process it follows.
+func (r ProcessRatio) target(of int) int {
+	t := int(math.Ceil(float64(of) * r.Ratio))
+	if t < r.Min {
+		t = r.Min
+	}
+	if r.Max > 0 && t > r.Max {
+		t = r.Max
+	}
+	return t
+}
+
+// groupMember Scaling Queue monitor of a ProcessGroup
+type groupMember struct {
+	q      Queue
+	rmqc   *rabbithole.Client
+	scaler *queueScaler
+}
+
+// scaleGroup - Poll every member queue, then scale all changed process types at once.
+func scaleGroup(g ProcessGroup, queues []Queue) {
+	log := logger.With("group", g.Name, "app", g.DeisApp)
+	var members []groupMember
+	for _, q := range queues {
+		members = append(members, groupMember{q: q, rmqc: amqConnection(q), scaler: newQueueScaler(q)})
+	}
+	for {
+		interval := 95 * time.Second
+		pods, err := deisPodCounts(g.DeisApp)
+		monitorPolled(g.Name, 0, 0, err)
+		if err != nil {
+			log.Error("Deis unable to list pods", "err", err)
+			for _, m := range members {
+				monitorPolled(m.q.monitorName(), 0, 0, err)
+			}
+			time.Sleep(interval)
+			continue
+		}
+
+		targets := map[string]int{}
+		// Targets actually applied, which ratios follow; dry-run members only record theirs
+		live := map[string]int{}
+		var events []Event
+		for _, m := range members {
+			q := m.q
+			start := time.Now()
+			mq, err := m.rmqc.GetQueue("/", q.Queue)
+			externalCall("rabbitmq", q.AmqHost, "get_queue", start, err)
+			if err != nil {
+				monitorPolled(q.monitorName(), 0, 0, err)
+				m.scaler.log.Error("Queue lookup failed", "err", err)
+				continue
+			}
+			podcount := pods[q.Worker]
+			monitorPolled(q.monitorName(), mq.Messages, podcount, nil)
+			m.scaler.log.Debug("Polled queue", "messages", mq.Messages, "pods", podcount)
+			podScaleEvent.With(prometheus.Labels{"service": q.monitorName(), "status": "success"}).Set(float64(podcount))
+			if queueControlled(q, mq.Messages, podcount) {
+				continue
+			}
+
+			desired, reason, code := m.scaler.decide(mq.Messages, podcount)
+			if desired != podcount {
+				targets[q.Worker] = desired
+				if !monitorDryRun(q.monitorName()) {
+					live[q.Worker] = desired
+				}
+				e := queueEvent(q, mq.Messages, podcount, code, reason)
+				e.Worker = q.Worker
+				events = append(events, e)
+			}
+			monitorDecided(q.monitorName(), m.scaler.report(mq.Messages, podcount, desired, reason, code))
+			if i := q.pollInterval(desired); i < interval {
+				interval = i
+			}
+		}
+
+		if len(g.Ratios) > 0 {
+			events = append(events, ratioEvents(g, pods, live, targets, log)...)
+		}
+
+		if len(targets) > 0 {
+			deisScaleTargets(g.DeisApp, targets, events)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// ratioEvents - Size the group's ratio workers into targets, unless the group is paused or inhibited.
+func ratioEvents(g ProcessGroup, pods map[string]int, live map[string]int, targets map[string]int, log *Logger) []Event {
+	if monitorPaused(g.Name) {
+		monitorDecided(g.Name, "paused")
+		return nil
+	}
+	if inhibitedDecision(g.Name, log) {
+		return nil
+	}
+	var events []Event
+	for _, r := range g.Ratios {
+		of, ok := live[r.Of]
+		if !ok {
+			of = pods[r.Of]
+		}
+		if t := r.target(of); t != pods[r.Worker] {
+			log.Info("Scaling by ratio", "worker", r.Worker, "of", r.Of, "pods", pods[r.Worker], "desired", t)
+			targets[r.Worker] = t
+			events = append(events, Event{
+				Monitor:     g.Name,
+				Worker:      r.Worker,
+				OldReplicas: pods[r.Worker],
+				Reason:      "ratio of " + r.Of,
+				ReasonCode:  reasonRatio,
+			})
+		}
+	}
+	monitorDecided(g.Name, fmt.Sprintf("%d ratio changes", len(events)))
+	return events
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Dependency Reachability of an external service Puppeteer relies on
+type Dependency struct {
+	Name        string    `json:"name"`
+	Kind        string    `json:"kind"`
+	Target      string    `json:"target"`
+	LastSuccess time.Time `json:"last_success"`
+	LastFailure time.Time `json:"last_failure"`
+	LastError   string    `json:"last_error,omitempty"`
+	Ready       bool      `json:"ready"`
+	// Polled every cycle by a monitor; dependencies only called on demand don't gate readiness
+	Polled bool `json:"polled"`
+}
+
+// MonitorLiveness Whether a monitor loop is still polling
+type MonitorLiveness struct {
+	Name     string    `json:"name"`
+	LastPoll time.Time `json:"last_poll"`
+	Alive    bool      `json:"alive"`
+}
+
+// Health Response body for the health and readiness probes
+type Health struct {
+	Status       string            `json:"status"`
+	Monitors     []MonitorLiveness `json:"monitors,omitempty"`
+	Dependencies []Dependency      `json:"dependencies,omitempty"`
+}
+
+// A dependency counts as reachable if it answered within this long
+const dependencyReadyWithin = 5 * time.Minute
+
+var (
+	healthMu     sync.Mutex
+	dependencies = map[string]*Dependency{}
+	depOrder     []string
+	startedAt    = time.Now()
+)
+
+// registerDependency - Track a dependency a monitor polls, not ready until first reached.
+func registerDependency(kind string, target string) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	trackDependency(kind, target).Polled = true
+}
+
+// trackDependency - Dependency entry of kind at target, added if new. Caller holds healthMu.
+func trackDependency(kind string, target string) *Dependency {
+	name := kind + ":" + target
+	if d, ok := dependencies[name]; ok {
+		return d
+	}
+	d := &Dependency{Name: name, Kind: kind, Target: target}
+	dependencies[name] = d
+	depOrder = append(depOrder, name)
+	return d
+}
+
+// dependencyChecked - Record the outcome of a call to a dependency.
+func dependencyChecked(kind string, target string, err error) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	d := trackDependency(kind, target)
+	if err != nil {
+		d.LastFailure = time.Now()
+		d.LastError = err.Error()
+		return
+	}
+	d.LastSuccess = time.Now()
+	d.LastError = ""
+}
+
+// dependencyFailing - Whether the last call to a dependency of kind, at target when set, failed.
+func dependencyFailing(kind string, target string) bool {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	for _, d := range dependencies {
+		if d.Kind == kind && (target == "" || d.Target == target) && d.LastError != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// dependencySnapshot - Copy of every dependency's state, in registration order.
+func dependencySnapshot() []Dependency {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	deps := []Dependency{}
+	for _, name := range depOrder {
+		d := *dependencies[name]
+		d.Ready = time.Since(d.LastSuccess) < dependencyReadyWithin
+		deps = append(deps, d)
+	}
+	return deps
+}
+
+func writeHealth(w http.ResponseWriter, h Health, ok bool) {
+	h.Status = "ok"
+	if !ok {
+		h.Status = "failing"
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, h)
+}
+
+// Healthz Liveness, every monitor loop has polled recently
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	ok := true
+	var h Health
+	for _, m := range statusSnapshot().Monitors {
+		// Webhook-only Alert monitors are not polled
+		if m.Source == "webhook" {
+			continue
+		}
+		alive := !m.stale()
+		if m.LastPoll.IsZero() {
+			alive = !MonitorStatus{LastPoll: startedAt, StaleAfter: m.StaleAfter}.stale()
+		}
+		ok = ok && alive
+		h.Monitors = append(h.Monitors, MonitorLiveness{Name: m.Name, LastPoll: m.LastPoll, Alive: alive})
+	}
+	writeHealth(w, h, ok)
+}
+
+// Readyz Readiness, every polled dependency was reachable recently
+func Readyz(w http.ResponseWriter, r *http.Request) {
+	ok := true
+	h := Health{Dependencies: dependencySnapshot()}
+	for _, d := range h.Dependencies {
+		ok = ok && (d.Ready || !d.Polled)
+	}
+	writeHealth(w, h, ok)
+}
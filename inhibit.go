@@ -0,0 +1,192 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Inhibit Condition suppressing monitor actions while it holds
+//
+// An alert condition holds while an alert matching Matchers fires, either
+// polled from AlertHost or pushed through the webhook receiver. A dependency
+// condition holds while the last call to Dependency (rabbitmq, deis, aws or
+// alertmanager), at Target when set, failed.
+type Inhibit struct {
+	Name       string
+	Matchers   []string
+	AlertHost  string
+	API        string
+	Dependency string
+	Target     string
+	// Monitors suppressed, every monitor when empty
+	Monitors []string
+}
+
+// InhibitStatus Current state of an Inhibit, for the status API
+type InhibitStatus struct {
+	Name     string   `json:"name"`
+	Active   bool     `json:"active"`
+	Reason   string   `json:"reason,omitempty"`
+	Monitors []string `json:"monitors,omitempty"`
+}
+
+// inhibitor Inhibit and the matching alerts currently firing
+type inhibitor struct {
+	Inhibit
+	matchers []labelMatcher
+	monitors map[string]bool
+	mu       sync.Mutex
+	firing   map[string]bool
+}
+
+var inhibitors []*inhibitor
+
+// defaultInhibits - The RabbitMQStatsZero kill switch, used when no inhibits are configured.
+//
+// Puppeteer used to stop alert restarts while RabbitMQStatsZero fired on the
+// alert's own AlertHost, because zeroed stats make every decision based on
+// them wrong. Keep exactly that: one inhibit per AlertHost, holding back only
+// the Alert monitors polling it. Webhook-only Alert monitors are held back by
+// the alert pushed through the webhook.
+func defaultInhibits() []Inhibit {
+	var inhibits []Inhibit
+	byHost := map[string]int{}
+	for _, a := range cfg.Alerts {
+		n, ok := byHost[a.AlertHost]
+		if !ok {
+			n = len(inhibits)
+			byHost[a.AlertHost] = n
+			inhibits = append(inhibits, Inhibit{
+				Name:      "RabbitMQStatsZero",
+				Matchers:  []string{`alertname="RabbitMQStatsZero"`},
+				AlertHost: a.AlertHost,
+				API:       a.API,
+			})
+		}
+		inhibits[n].Monitors = append(inhibits[n].Monitors, a.Name)
+	}
+	return inhibits
+}
+
+// inhibitRunner - Set up the configured inhibits and poll the ones with an AlertHost.
+func inhibitRunner() {
+	inhibits := cfg.Inhibits
+	if len(inhibits) == 0 {
+		inhibits = defaultInhibits()
+	}
+	for _, inh := range inhibits {
+		if len(inh.Matchers) == 0 && inh.Dependency == "" {
+			logger.Panic("Inhibit needs matchers or a dependency", "inhibit", inh.Name)
+		}
+		i := &inhibitor{
+			Inhibit:  inh,
+			matchers: compileMatchers(inh.Name, inh.Matchers),
+			monitors: map[string]bool{},
+			firing:   map[string]bool{},
+		}
+		for _, m := range inh.Monitors {
+			i.monitors[m] = true
+		}
+		inhibitors = append(inhibitors, i)
+		if inh.AlertHost != "" && len(i.matchers) > 0 {
+			registerDependency("alertmanager", inh.AlertHost)
+			go i.poll()
+		}
+	}
+}
+
+// poll - Replace the firing alerts with the matching ones from AlertHost every minute.
+func (i *inhibitor) poll() {
+	for {
+		start := time.Now()
+		alerts, err := fetchAlerts(i.AlertHost, i.API)
+		externalCall("alertmanager", i.AlertHost, "get_alerts", start, err)
+		if err != nil {
+			logger.Error("Alertmanager lookup for inhibit failed", "inhibit", i.Name, "err", err)
+		} else {
+			firing := map[string]bool{}
+			for _, a := range alerts {
+				if !a.suppressed() && matchAll(i.matchers, a.Labels) {
+					firing[a.key()] = true
+				}
+			}
+			i.mu.Lock()
+			i.firing = firing
+			i.mu.Unlock()
+		}
+		time.Sleep(60 * time.Second)
+	}
+}
+
+// notify - Track an alert pushed through the webhook receiver.
+func (i *inhibitor) notify(a amAlert, firing bool) {
+	if len(i.matchers) == 0 || !matchAll(i.matchers, a.Labels) {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if firing {
+		i.firing[a.key()] = true
+	} else {
+		delete(i.firing, a.key())
+	}
+}
+
+// active - Why the condition holds, empty when it doesn't.
+func (i *inhibitor) active() string {
+	i.mu.Lock()
+	n := len(i.firing)
+	i.mu.Unlock()
+	if n > 0 {
+		return "alert firing"
+	}
+	if i.Dependency != "" && dependencyFailing(i.Dependency, i.Target) {
+		return i.Dependency + " failing"
+	}
+	return ""
+}
+
+// applies - Whether the inhibit covers the named monitor.
+func (i *inhibitor) applies(monitor string) bool {
+	return len(i.monitors) == 0 || i.monitors[monitor]
+}
+
+// notifyInhibits - Feed a webhook alert to every inhibit.
+func notifyInhibits(a amAlert, firing bool) {
+	for _, i := range inhibitors {
+		i.notify(a, firing)
+	}
+}
+
+// monitorInhibited - Names of the active inhibits suppressing a monitor.
+func monitorInhibited(monitor string) []string {
+	var names []string
+	for _, i := range inhibitors {
+		if i.applies(monitor) && i.active() != "" {
+			names = append(names, i.Name)
+		}
+	}
+	return names
+}
+
+// inhibitedDecision - Record that a monitor did nothing because of inhibits, true if it is inhibited.
+func inhibitedDecision(monitor string, log *Logger) bool {
+	names := monitorInhibited(monitor)
+	if len(names) == 0 {
+		return false
+	}
+	log.Warn("Inhibited, not acting", "inhibits", strings.Join(names, ","))
+	monitorDecided(monitor, "inhibited by "+strings.Join(names, ", "))
+	return true
+}
+
+// inhibitSnapshot - State of every inhibit.
+func inhibitSnapshot() []InhibitStatus {
+	out := []InhibitStatus{}
+	for _, i := range inhibitors {
+		reason := i.active()
+		out = append(out, InhibitStatus{Name: i.Name, Active: reason != "", Reason: reason, Monitors: i.Monitors})
+	}
+	return out
+}
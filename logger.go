@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level Log severity
+type Level int
+
+// Log levels, lowest to highest
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (lv Level) String() string {
+	if lv < LevelDebug || lv > LevelError {
+		return "unknown"
+	}
+	return levelNames[lv]
+}
+
+// ParseLevel - Level from its name, falling back to def when empty or unknown.
+func ParseLevel(s string, def Level) Level {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i)
+		}
+	}
+	if strings.EqualFold(s, "warning") {
+		return LevelWarn
+	}
+	return def
+}
+
+// LogConfig Logging Settings
+type LogConfig struct {
+	// debug, info, warn or error
+	Level string
+	// logfmt or json
+	Format string
+}
+
+// Logger Leveled logger writing logfmt or JSON lines with context fields
+type Logger struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	json   bool
+	level  Level
+	fields []interface{}
+}
+
+// NewLogger - Logger writing to w in format ("logfmt" or "json") at level and above.
+func NewLogger(w io.Writer, format string, level Level) *Logger {
+	return &Logger{
+		mu:    &sync.Mutex{},
+		w:     w,
+		json:  strings.EqualFold(format, "json"),
+		level: level,
+	}
+}
+
+// With - Child logger adding key/value context fields to every line.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	child := *l
+	child.fields = append(append([]interface{}{}, l.fields...), kv...)
+	return &child
+}
+
+// WithLevel - Child logger with level parsed from s, keeping the current level when s is empty.
+func (l *Logger) WithLevel(s string) *Logger {
+	child := *l
+	child.level = ParseLevel(s, l.level)
+	return &child
+}
+
+// Debug - Log at debug level
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+
+// Info - Log at info level
+func (l *Logger) Info(msg string, kv ...interface{}) { l.log(LevelInfo, msg, kv) }
+
+// Warn - Log at warn level
+func (l *Logger) Warn(msg string, kv ...interface{}) { l.log(LevelWarn, msg, kv) }
+
+// Error - Log at error level
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+// Panic - Log at error level, then panic with msg
+func (l *Logger) Panic(msg string, kv ...interface{}) {
+	l.log(LevelError, msg, kv)
+	panic(msg)
+}
+
+// Fatal - Log at error level, then exit
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.log(LevelError, msg, kv)
+	os.Exit(1)
+}
+
+func (l *Logger) log(lv Level, msg string, kv []interface{}) {
+	if lv < l.level {
+		return
+	}
+	pairs := append([]interface{}{"time", time.Now().UTC().Format(time.RFC3339), "level", lv.String(), "msg", msg}, l.fields...)
+	pairs = append(pairs, kv...)
+	if len(pairs)%2 != 0 {
+		pairs = append(pairs, "(MISSING)")
+	}
+
+	var line []byte
+	if l.json {
+		line = jsonLine(pairs)
+	} else {
+		line = logfmtLine(pairs)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(line)
+}
+
+func fieldValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case error:
+		return t.Error()
+	case fmt.Stringer:
+		return t.String()
+	}
+	return v
+}
+
+func jsonLine(pairs []interface{}) []byte {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(fmt.Sprint(pairs[i]))
+		v, err := json.Marshal(fieldValue(pairs[i+1]))
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(pairs[i+1]))
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteString("}\n")
+	return []byte(b.String())
+}
+
+func logfmtLine(pairs []interface{}) []byte {
+	var b strings.Builder
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(fmt.Sprint(pairs[i]))
+		b.WriteByte('=')
+		v := fmt.Sprint(fieldValue(pairs[i+1]))
+		if v == "" || strings.ContainsAny(v, " =\"\t\n") {
+			v = strconv.Quote(v)
+		}
+		b.WriteString(v)
+	}
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+// logger Process wide logger, reconfigured from cfg.Log by Init
+var logger = NewLogger(os.Stdout, "logfmt", LevelInfo)
+
+// Init Logging
+func Init(w io.Writer, c LogConfig) {
+	logger = NewLogger(w, c.Format, ParseLevel(c.Level, LevelInfo))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLogfmtLine(t *testing.T) {
+	var buf bytes.Buffer
+	log := NewLogger(&buf, "logfmt", LevelInfo).With("monitor", "app-cmd", "queue", "jobs created")
+	log.Debug("Polled queue", "messages", 3)
+	log.Info("Scaling up", "pods", 2, "err", errors.New("boom"), "reason", "")
+
+	line := buf.String()
+	if strings.Count(line, "\n") != 1 {
+		t.Fatalf("want one line, debug filtered out, got %q", line)
+	}
+	if !strings.HasPrefix(line, "time=") {
+		t.Errorf("line should start with time, got %q", line)
+	}
+	want := ` level=info msg="Scaling up" monitor=app-cmd queue="jobs created" pods=2 err=boom reason=""` + "\n"
+	if !strings.HasSuffix(line, want) {
+		t.Errorf("got %q, want suffix %q", line, want)
+	}
+}
+
+func TestJSONLine(t *testing.T) {
+	var buf bytes.Buffer
+	log := NewLogger(&buf, "json", LevelWarn).With("monitor", "app-cmd").WithLevel("debug")
+	log.Debug("Polled queue", "messages", 3, "odd")
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON %q: %v", buf.String(), err)
+	}
+	want := map[string]interface{}{
+		"level":    "debug",
+		"msg":      "Polled queue",
+		"monitor":  "app-cmd",
+		"messages": float64(3),
+		"odd":      "(MISSING)",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+	if _, ok := got["time"]; !ok {
+		t.Errorf("missing time in %q", buf.String())
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Level
+	}{
+		{"debug", LevelDebug},
+		{"INFO", LevelInfo},
+		{"warning", LevelWarn},
+		{"error", LevelError},
+		{"", LevelInfo},
+		{"verbose", LevelInfo},
+	}
+	for _, tt := range tests {
+		if got := ParseLevel(tt.in, LevelInfo); got != tt.want {
+			t.Errorf("ParseLevel(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
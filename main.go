@@ -1,13 +1,10 @@
 package main
 
 import (
-	"fmt"
-	"io"
 	"io/ioutil"
-	"log"
-	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/kelseyhightower/envconfig"
@@ -19,19 +16,21 @@ import (
 	deisauth "github.com/deis/controller-sdk-go/auth"
 )
 
-var (
-	// Info Logger
-	Info *log.Logger
-	// Warning Logger
-	Warning *log.Logger
-)
-
 // Config File Settings
 type Config struct {
 	Enabled bool
 	Queues  []Queue
 	Alerts  []Alert
 	ASG     []ASG
+	Events  EventConfig
+	Auth    AuthConfig
+	Log     LogConfig
+	History HistoryConfig
+	Groups  []ProcessGroup
+	// Conditions suppressing actions, RabbitMQStatsZero firing when empty
+	Inhibits []Inhibit
+	// Destinations told about actions
+	Notifiers []NotifierConfig
 }
 
 // Queue Monitoring Definitions
@@ -46,6 +45,36 @@ type Queue struct {
 	Method    string
 	DeisApp   string
 	Worker    string
+	LogLevel  string
+	// Seconds a scale-down must be sustained for, 0 disables
+	StabilizationWindow int
+	// Pods removed per scale-down, default 1
+	ScaleDownBy int
+	// Rate limit policies per direction
+	ScaleUp   ScaleRules
+	ScaleDown ScaleRules
+	// Pods outside ScaleMin..ScaleMax: ignore, correct or respect
+	OutOfRange string
+	// Pods moved per correction cycle, 0 moves straight into range
+	OutOfRangeStep int
+	// Seconds a manual change is respected before correcting
+	ManualGracePeriod int
+	// Time windows changing ScaleMin/ScaleMax or pinning the pod count
+	Schedules []Schedule
+	Predict   PredictConfig
+	// Scale to zero when idle, wake on the first message
+	Idle IdleConfig
+	// ProcessGroup scaling this worker together with others of the app
+	Group string
+	// Stuck consumer checks of the restart method
+	Restart RestartConfig
+	// Decide as usual, but only record would-be actions
+	DryRun bool
+}
+
+// monitorName - Name identifying a Queue monitor, its Deis app and worker.
+func (q Queue) monitorName() string {
+	return q.DeisApp + "-" + q.Worker
 }
 
 // Alert Prometheus Alert Definitions
@@ -55,6 +84,25 @@ type Alert struct {
 	Method    string
 	DeisApp   string
 	Worker    string
+	LogLevel  string
+	// Alertmanager API version, v1 (default) or v2
+	API string
+	// Label matchers like service=~"foo|bar", alertname=Name when empty
+	Matchers []string
+	// Seconds an alert must have been firing before acting on it
+	For int
+	// Action parameters. DeisApp, Worker, Monitor, ASG and URL are templates
+	// over the alert, e.g. "{{ .Labels.service }}-prod"
+	// Pods (scaleto) or instances (scaleasg) to scale to, explicitly 0 is allowed
+	Replicas  *int
+	By        int
+	Monitor   string
+	ASG       string
+	AWSRegion string
+	URL       string
+	DryRun    bool
+	// How the worker is restarted, only mode, maxunavailable and readytimeout apply
+	Restart RestartConfig
 }
 
 // ASG (autoscale Group) Group Definitions
@@ -68,6 +116,24 @@ type ASG struct {
 	Watermark       int
 	Method          string
 	DisableCoolDown bool
+	LogLevel        string
+	// Seconds a scale-down must be sustained for, 0 disables
+	StabilizationWindow int
+	// Instances added/removed per step, default 4 and 2
+	ScaleUpBy   int
+	ScaleDownBy int
+	// Rate limit policies per direction
+	ScaleUp   ScaleRules
+	ScaleDown ScaleRules
+	// Time windows changing the group's min/max or pinning its capacity
+	Schedules []Schedule
+	Predict   PredictConfig
+	// Decide as usual, but only record would-be actions, like Enabled false
+	DryRun bool
+	// Drain instances before terminating them on scale-in
+	ScaleIn ScaleInConfig
+	// Protect busy instances from scale-in
+	Protection ProtectionConfig
 }
 
 // Deis Client and Token Definitions
@@ -92,7 +158,7 @@ func LoadConfig() Config {
 	filename, _ := filepath.Abs(puppetConfig)
 	yamlFile, err := ioutil.ReadFile(filename)
 	if err != nil {
-		Warning.Panic("Unable to Read Config file", err)
+		logger.Panic("Unable to Read Config file", "file", filename, "err", err)
 	}
 
 	var config Config
@@ -100,7 +166,7 @@ func LoadConfig() Config {
 
 	err = yaml.Unmarshal(yamlFile, &config)
 	if err != nil {
-		Warning.Panic("Unable to Unmarshal Config", err)
+		logger.Panic("Unable to Unmarshal Config", "file", filename, "err", err)
 	}
 	if os.Getenv("STATE") == "enabled" {
 		config.Enabled = true
@@ -108,7 +174,7 @@ func LoadConfig() Config {
 	return config
 }
 
-var cfg = LoadConfig()
+var cfg Config
 var deiscfg Deis
 
 func deisAuth() {
@@ -116,15 +182,17 @@ func deisAuth() {
 	var creds DeisCreds
 	err := envconfig.Process("DEIS", &creds)
 	if err != nil {
-		Warning.Panic(err.Error())
+		logger.Panic("Unable to Read Deis Env", "err", err)
 	}
 	client, err := deis.New(true, creds.URL, "")
 	if err != nil {
-		Warning.Panic("Deis New Creds URL", err)
+		logger.Panic("Deis New Creds URL", "err", err)
 	}
+	start := time.Now()
 	token, err := deisauth.Login(client, creds.Username, creds.Password)
+	externalCall("deis", "controller", "login", start, err)
 	if err != nil {
-		Warning.Panic("Deis Auth Login Failed", err)
+		logger.Panic("Deis Auth Login Failed", "err", err)
 	}
 	// Set the client to use the retrieved token
 	client.Token = token
@@ -132,59 +200,66 @@ func deisAuth() {
 	deiscfg.Token = token
 }
 
-// Init Logging
-func Init(
-	infoHandle io.Writer,
-	warningHandle io.Writer) {
-
-	Info = log.New(infoHandle,
-		"INFO: ",
-		log.Ldate|log.Ltime|log.Lshortfile)
-
-	Warning = log.New(warningHandle,
-		"WARNING: ",
-		log.Ldate|log.Ltime|log.Lshortfile)
-}
-
 func init() {
 	// Metrics have to be registered to be exposed:
 	prometheus.MustRegister(podScaleEvent)
 	prometheus.MustRegister(serviceRestart)
 	prometheus.MustRegister(promASGcount)
 	prometheus.MustRegister(promASGscale)
+	prometheus.MustRegister(promQueueDepth)
+	prometheus.MustRegister(promThreshold)
+	prometheus.MustRegister(promWatermark)
+	prometheus.MustRegister(promReplicasCurrent)
+	prometheus.MustRegister(promReplicasDesired)
+	prometheus.MustRegister(promReplicasMin)
+	prometheus.MustRegister(promReplicasMax)
+	prometheus.MustRegister(promDecisions)
+	prometheus.MustRegister(promPredictedDepth)
+	prometheus.MustRegister(promCallDuration)
+	prometheus.MustRegister(promDependencyErrors)
 }
 
 func main() {
+	cfg = LoadConfig()
+	// Show scheduled limits and exit
+	if len(os.Args) > 1 && os.Args[1] == "preview" {
+		previewSchedules(os.Stdout, time.Now())
+		return
+	}
 	// Initialize logging
-	Init(os.Stdout, os.Stdout)
+	Init(os.Stdout, cfg.Log)
+	// Action history
+	eventLog = NewEventLog(cfg.Events)
+	// API tokens and client certificates
+	auth = NewAuthenticator(cfg.Auth)
 	// Auth to Deis, Env Vars
 	deisAuth()
+	notifierRunner()
+	// Inhibits before the monitors they suppress
+	inhibitRunner()
 	// Start Queue Monitors
 	go queueRunner()
 
-	// Start Alert Runner
-	go alertRunner()
+	// Start Alert Runner, its rules built before the webhook receiver serves
+	alertRunner()
 
 	// Start ASG scaleRunner
 	go scaleRunner()
 
 	// TODO: Rework for more flexibility
 	router := mux.NewRouter().StrictSlash(true)
-	router.HandleFunc("/", Index)
-	router.Handle("/metrics", promhttp.Handler())
-	Warning.Fatal(http.ListenAndServe(":8080", router))
-}
-
-// Index Print Status of Service
-func Index(w http.ResponseWriter, r *http.Request) {
-	queues := cfg.Queues
-	for _, queue := range queues {
-		fmt.Fprintf(w, "%s-%s\n", queue.DeisApp, queue.Worker)
-		fmt.Fprintln(w, "\tqueue: ", queue.Queue)
-		fmt.Fprintln(w, "\tEnv: ", queue.AmqHost)
-		fmt.Fprintln(w, "\tMethod: ", queue.Method)
-		fmt.Fprintln(w, "\tThreshold: ", queue.Threshold)
-		fmt.Fprintln(w, "\tWatermark: ", queue.Watermark)
-		fmt.Fprintln(w, "\tScale By: ", queue.ScaleBy)
-	}
+	router.HandleFunc("/", auth.reader(Index))
+	router.Handle("/metrics", auth.open(cfg.Auth.OpenMetrics, promhttp.Handler().ServeHTTP))
+	router.HandleFunc("/healthz", auth.open(cfg.Auth.OpenHealth, Healthz))
+	router.HandleFunc("/readyz", auth.open(cfg.Auth.OpenHealth, Readyz))
+	router.HandleFunc("/api/v1/events", auth.reader(Events)).Methods("GET")
+	router.HandleFunc("/api/v1/status", auth.reader(StatusAPI)).Methods("GET")
+	router.HandleFunc("/api/v1/alerts/webhook", auth.operator(AlertWebhook)).Methods("POST")
+	router.HandleFunc("/api/v1/mode", auth.operator(SetMode)).Methods("POST")
+	router.HandleFunc("/api/v1/monitors/{name}/pause", auth.operator(PauseMonitor)).Methods("POST")
+	router.HandleFunc("/api/v1/monitors/{name}/resume", auth.operator(ResumeMonitor)).Methods("POST")
+	router.HandleFunc("/api/v1/monitors/{name}/dryrun", auth.operator(DryRunMonitor)).Methods("POST")
+	router.HandleFunc("/api/v1/monitors/{name}/override", auth.operator(OverrideMonitor)).Methods("POST")
+	router.HandleFunc("/api/v1/monitors/{name}/restart", auth.operator(RestartMonitor)).Methods("POST")
+	logger.Fatal("HTTP server stopped", "err", listenAndServe(":8080", cfg.Auth, router))
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -40,3 +42,156 @@ var (
 		[]string{"name"},
 	)
 )
+
+var (
+	promQueueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "puppeteer",
+			Name:      "queue_depth",
+			Help:      "Observed Queue Depth a Monitor bases its Decisions on",
+		},
+		[]string{"monitor", "queue"},
+	)
+
+	promThreshold = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "puppeteer",
+			Name:      "threshold",
+			Help:      "Configured Scale Up Threshold",
+		},
+		[]string{"monitor"},
+	)
+
+	promWatermark = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "puppeteer",
+			Name:      "watermark",
+			Help:      "Configured Scale Down Watermark",
+		},
+		[]string{"monitor"},
+	)
+
+	promReplicasCurrent = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "puppeteer",
+			Name:      "replicas_current",
+			Help:      "Current Pod or Instance Count",
+		},
+		[]string{"monitor"},
+	)
+
+	promReplicasDesired = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "puppeteer",
+			Name:      "replicas_desired",
+			Help:      "Pod or Instance Count last Requested",
+		},
+		[]string{"monitor"},
+	)
+
+	promReplicasMin = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "puppeteer",
+			Name:      "replicas_min",
+			Help:      "Minimum Pod or Instance Count",
+		},
+		[]string{"monitor"},
+	)
+
+	promReplicasMax = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "puppeteer",
+			Name:      "replicas_max",
+			Help:      "Maximum Pod or Instance Count",
+		},
+		[]string{"monitor"},
+	)
+
+	promDecisions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "puppeteer",
+			Name:      "decisions_total",
+			Help:      "Scale and Restart Decisions by Direction and Reason",
+		},
+		[]string{"monitor", "direction", "reason", "dry_run"},
+	)
+
+	promPredictedDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "puppeteer",
+			Name:      "predicted_queue_depth",
+			Help:      "Queue Depth Predicted for Lookahead Minutes from now",
+		},
+		[]string{"monitor"},
+	)
+
+	promCallDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "puppeteer",
+			Name:      "external_call_duration_seconds",
+			Help:      "Latency of Calls to RabbitMQ, Deis, AWS and Alertmanager",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"dependency", "operation"},
+	)
+
+	promDependencyErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "puppeteer",
+			Name:      "dependency_errors_total",
+			Help:      "Failed Calls per Dependency",
+		},
+		[]string{"dependency", "operation"},
+	)
+)
+
+// externalCall - Record latency and outcome of a call to a dependency, started at start.
+func externalCall(kind string, target string, operation string, start time.Time, err error) {
+	observeCall(kind, operation, start, err)
+	dependencyChecked(kind, target, err)
+}
+
+// observeCall - Record latency and failure of a call to an occasional target,
+// one not tracked for readiness.
+func observeCall(kind string, operation string, start time.Time, err error) {
+	promCallDuration.With(prometheus.Labels{"dependency": kind, "operation": operation}).Observe(time.Since(start).Seconds())
+	if err != nil {
+		promDependencyErrors.With(prometheus.Labels{"dependency": kind, "operation": operation}).Inc()
+	}
+}
+
+// decisionDirection - Direction label for an action Event.
+func decisionDirection(e Event) string {
+	switch {
+	case e.Type == "restart":
+		return "restart"
+	case e.Type == "webhook":
+		return "webhook"
+	case e.NewReplicas > e.OldReplicas:
+		return "up"
+	case e.NewReplicas < e.OldReplicas:
+		return "down"
+	}
+	return "none"
+}
+
+// Reason codes, the reason label of puppeteer_decisions_total. Each Event
+// gets one where its decision is made; its Reason keeps the details.
+const (
+	reasonOverThreshold   = "over_threshold"
+	reasonUnderWatermark  = "under_watermark"
+	reasonWithinThreshold = "within_threshold"
+	reasonPredicted       = "predicted"
+	reasonSchedule        = "schedule"
+	reasonOutOfRange      = "out_of_range"
+	reasonIdle            = "idle"
+	reasonRatio           = "ratio"
+	reasonOverride        = "override"
+	reasonManual          = "manual"
+	reasonAlert           = "alert"
+	reasonStuck           = "stuck"
+	reasonUnhealthyPods   = "unhealthy_pods"
+	reasonTerminate       = "terminate"
+	reasonProtect         = "protect"
+	reasonOther           = "other"
+)
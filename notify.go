@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NotifierConfig Destination told about Puppeteer's actions
+type NotifierConfig struct {
+	Name string
+	// webhook, slack or smtp
+	Type string
+	// webhook and slack: URL posted to
+	URL string
+	// smtp: host:port, sender, recipients, and the env var holding the password
+	SMTPHost    string
+	Username    string
+	PasswordEnv string
+	From        string
+	To          []string
+	// Event kinds sent: scale_up, scale_down, restart, max, error. All when empty
+	Events []string
+	// Seconds events are collected into one message, default 60
+	BatchInterval int
+	// Messages sent per hour at most, 0 is unlimited. Events wait for the next allowed message
+	MaxPerHour int
+}
+
+// Pending events kept per notifier while rate limited, older ones are dropped
+const maxPendingEvents = 500
+
+// notifier Batches matching events and sends them to one destination
+type notifier struct {
+	NotifierConfig
+	kinds   map[string]bool
+	mu      sync.Mutex
+	pending []Event
+	dropped int
+	sent    []time.Time
+}
+
+var notifiers []*notifier
+
+// notifierRunner - Start a sender per configured notifier.
+func notifierRunner() {
+	for _, c := range cfg.Notifiers {
+		switch c.Type {
+		case "webhook", "slack", "smtp":
+		default:
+			logger.Panic("Invalid notifier type", "notifier", c.Name, "type", c.Type)
+		}
+		n := &notifier{NotifierConfig: c, kinds: map[string]bool{}}
+		for _, k := range c.Events {
+			n.kinds[k] = true
+		}
+		notifiers = append(notifiers, n)
+		go n.run()
+	}
+}
+
+// eventKinds - Notification kinds an Event belongs to.
+func eventKinds(e Event) []string {
+	var kinds []string
+	if e.Result == "failed" {
+		kinds = append(kinds, "error")
+	}
+	switch decisionDirection(e) {
+	case "restart":
+		kinds = append(kinds, "restart")
+	case "up":
+		kinds = append(kinds, "scale_up")
+		if reachedMax(e) {
+			kinds = append(kinds, "max")
+		}
+	case "down":
+		kinds = append(kinds, "scale_down")
+	}
+	return kinds
+}
+
+// reachedMax - Whether a scale-up took the monitor to its current maximum.
+func reachedMax(e Event) bool {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	s, ok := statusBoard[e.Monitor]
+	return ok && s.Max > 0 && e.NewReplicas >= s.Max
+}
+
+// notifyEvent - Queue an Event with every notifier interested in it.
+func notifyEvent(e Event) {
+	kinds := eventKinds(e)
+	for _, n := range notifiers {
+		for _, k := range kinds {
+			if len(n.kinds) == 0 || n.kinds[k] {
+				n.add(e)
+				break
+			}
+		}
+	}
+}
+
+func (n *notifier) add(e Event) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.pending = append(n.pending, e)
+	if over := len(n.pending) - maxPendingEvents; over > 0 {
+		n.pending = n.pending[over:]
+		n.dropped += over
+	}
+}
+
+// run - Send pending events every BatchInterval, within MaxPerHour.
+func (n *notifier) run() {
+	interval := time.Duration(n.BatchInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	for {
+		time.Sleep(interval)
+		if !n.allowed() {
+			continue
+		}
+		n.mu.Lock()
+		events, dropped := n.pending, n.dropped
+		n.pending, n.dropped = nil, 0
+		n.mu.Unlock()
+		if len(events) == 0 {
+			continue
+		}
+
+		n.sent = append(n.sent, time.Now())
+		start := time.Now()
+		err := n.send(events, dropped)
+		observeCall("notifier", n.Type, start, err)
+		if err != nil {
+			logger.Error("Notification failed", "notifier", n.Name, "events", len(events), "err", err)
+		} else {
+			logger.Debug("Notification sent", "notifier", n.Name, "events", len(events))
+		}
+	}
+}
+
+// allowed - Whether another message fits within MaxPerHour.
+func (n *notifier) allowed() bool {
+	kept := n.sent[:0]
+	for _, t := range n.sent {
+		if time.Since(t) < time.Hour {
+			kept = append(kept, t)
+		}
+	}
+	n.sent = kept
+	return n.MaxPerHour <= 0 || len(n.sent) < n.MaxPerHour
+}
+
+// eventLine - One line summary of an Event.
+func eventLine(e Event) string {
+	target := e.Monitor
+	if e.App != "" {
+		target = e.App + "/" + e.Worker
+	} else if e.ASG != "" {
+		target = e.ASG
+	}
+	line := fmt.Sprintf("%s %s %s", e.Time.Format(time.RFC3339), e.Type, target)
+	if e.Type != "restart" && e.Type != "webhook" {
+		line += fmt.Sprintf(" %d -> %d", e.OldReplicas, e.NewReplicas)
+	}
+	line += fmt.Sprintf(" (%s) %s", e.Reason, e.Result)
+	if e.Error != "" {
+		line += ": " + e.Error
+	}
+	return line
+}
+
+// summary - Text of a batch, one line per event.
+func summary(events []Event, dropped int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Puppeteer: %d actions\n", len(events)+dropped)
+	for _, e := range events {
+		b.WriteString(eventLine(e) + "\n")
+	}
+	if dropped > 0 {
+		fmt.Fprintf(&b, "(%d older events dropped)\n", dropped)
+	}
+	return b.String()
+}
+
+func (n *notifier) send(events []Event, dropped int) error {
+	switch n.Type {
+	case "webhook":
+		return postJSON(http.DefaultClient, n.URL, map[string]interface{}{"notifier": n.Name, "events": events, "dropped": dropped})
+	case "slack":
+		return postJSON(http.DefaultClient, n.URL, map[string]string{"text": summary(events, dropped)})
+	}
+	return n.sendMail(events, dropped)
+}
+
+func postJSON(client *http.Client, url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+func (n *notifier) sendMail(events []Event, dropped int) error {
+	var a smtp.Auth
+	if n.Username != "" {
+		host := strings.Split(n.SMTPHost, ":")[0]
+		a = smtp.PlainAuth("", n.Username, os.Getenv(n.PasswordEnv), host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: Puppeteer: %d actions\r\n\r\n%s",
+		n.From, strings.Join(n.To, ", "), len(events)+dropped, strings.Replace(summary(events, dropped), "\n", "\r\n", -1))
+	return smtp.SendMail(n.SMTPHost, a, n.From, n.To, []byte(msg))
+}
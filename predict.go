@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// HistoryConfig Queue Depth History Settings
+type HistoryConfig struct {
+	// Directory for per monitor history files, in memory only when empty
+	Dir string
+	// Days of history kept, default 8
+	Days int
+}
+
+// PredictConfig Predictive Scaling Settings of a monitor
+type PredictConfig struct {
+	Enabled bool
+	// Minutes ahead to predict, default 15
+	Lookahead int
+	// Scale up on the prediction, otherwise only export it
+	Actuate bool
+}
+
+// depthSample Queue depth observed at a time
+type depthSample struct {
+	T int64 `json:"t"`
+	D int   `json:"d"`
+}
+
+const week = 7 * 24 * time.Hour
+
+// Samples within this distance of a time are averaged to get the depth at it
+const sampleSpan = 5 * time.Minute
+
+// predictor Depth history of a monitor and a same-time-last-week forecast
+type predictor struct {
+	mu        sync.Mutex
+	monitor   string
+	cfg       PredictConfig
+	keep      time.Duration
+	file      string
+	samples   []depthSample
+	compacted time.Time
+}
+
+// newPredictor - Predictor for monitor, loading stored history from hc.Dir.
+func newPredictor(monitor string, c PredictConfig, hc HistoryConfig) *predictor {
+	days := hc.Days
+	if days <= 0 {
+		days = 8
+	}
+	if c.Lookahead <= 0 {
+		c.Lookahead = 15
+	}
+	p := &predictor{monitor: monitor, cfg: c, keep: time.Duration(days) * 24 * time.Hour}
+	if hc.Dir == "" || !c.Enabled {
+		return p
+	}
+	p.file = filepath.Join(hc.Dir, monitor+".jsonl")
+	if f, err := os.Open(p.file); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var s depthSample
+			if json.Unmarshal(scanner.Bytes(), &s) == nil {
+				p.samples = append(p.samples, s)
+			}
+		}
+		f.Close()
+	}
+	p.compact(time.Now())
+	return p
+}
+
+// observe - Add a depth sample, persisting it when a history dir is set.
+func (p *predictor) observe(depth int) {
+	if !p.cfg.Enabled {
+		return
+	}
+	now := time.Now()
+	s := depthSample{T: now.Unix(), D: depth}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.samples = append(p.samples, s)
+	if p.file == "" {
+		p.prune(now)
+		return
+	}
+	if now.Sub(p.compacted) > 24*time.Hour {
+		p.compact(now)
+		return
+	}
+	f, err := os.OpenFile(p.file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		logger.Warn("Unable to write depth history", "monitor", p.monitor, "err", err)
+		return
+	}
+	line, _ := json.Marshal(s)
+	f.Write(append(line, '\n'))
+	f.Close()
+}
+
+// prune - Drop samples older than the retention.
+func (p *predictor) prune(now time.Time) {
+	cutoff := now.Add(-p.keep).Unix()
+	i := 0
+	for i < len(p.samples) && p.samples[i].T < cutoff {
+		i++
+	}
+	p.samples = p.samples[i:]
+}
+
+// compact - Prune and rewrite the history file with only retained samples.
+func (p *predictor) compact(now time.Time) {
+	p.prune(now)
+	p.compacted = now
+	if p.file == "" {
+		return
+	}
+	tmp := p.file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		logger.Warn("Unable to write depth history", "monitor", p.monitor, "err", err)
+		return
+	}
+	w := bufio.NewWriter(f)
+	for _, s := range p.samples {
+		line, _ := json.Marshal(s)
+		w.Write(append(line, '\n'))
+	}
+	w.Flush()
+	f.Close()
+	if err := os.Rename(tmp, p.file); err != nil {
+		logger.Warn("Unable to write depth history", "monitor", p.monitor, "err", err)
+	}
+}
+
+// depthAt - Average depth of samples around t, false when there are none.
+func (p *predictor) depthAt(t time.Time) (int, bool) {
+	from, to := t.Add(-sampleSpan).Unix(), t.Add(sampleSpan).Unix()
+	var sum, n int
+	for _, s := range p.samples {
+		if s.T >= from && s.T <= to {
+			sum += s.D
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, false
+	}
+	return sum / n, true
+}
+
+// predict - Expected depth Lookahead minutes from now.
+//
+// The depth at that time last week, shifted by how much the depth now differs
+// from the depth at this time last week. False without a week of history.
+func (p *predictor) predict() (int, bool) {
+	if !p.cfg.Enabled {
+		return 0, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	ahead := now.Add(time.Duration(p.cfg.Lookahead) * time.Minute)
+	lastWeekAhead, ok := p.depthAt(ahead.Add(-week))
+	if !ok {
+		return 0, false
+	}
+	lastWeekNow, ok := p.depthAt(now.Add(-week))
+	if !ok {
+		return 0, false
+	}
+	current, ok := p.depthAt(now)
+	if !ok {
+		return 0, false
+	}
+	predicted := lastWeekAhead + (current - lastWeekNow)
+	if predicted < 0 {
+		predicted = 0
+	}
+	promPredictedDepth.With(prometheus.Labels{"monitor": p.monitor}).Set(float64(predicted))
+	return predicted, true
+}
+
+// signal - Depth to base decisions on: the prediction when actuating and it is higher.
+func (p *predictor) signal(messages int) (int, bool) {
+	predicted, ok := p.predict()
+	if !ok || !p.cfg.Actuate || predicted <= messages {
+		return messages, false
+	}
+	return predicted, true
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+)
+
+// ProtectionConfig Scale-in protection of busy ASG instances
+//
+// Every poll each in-service instance is asked whether it is busy, and is
+// protected from scale-in while it is, so scale-down only removes idle ones.
+type ProtectionConfig struct {
+	// Answers {"busy": bool}; {instance_id}, {az}, {asg} and {address} are
+	// replaced, without {instance_id} ?instance_id=<id> is added
+	BusyURL string
+	// Answers {"address": "<host or ip>"} for ?instance_id=<id>, the instance's {address}
+	AddressURL string
+}
+
+// Instances changed per SetInstanceProtection call, the API's limit
+const protectionBatch = 50
+
+// Busy checks run at once, and how long a poll waits for all of them
+const (
+	busyChecksAtOnce = 10
+	busyChecksWithin = 15 * time.Second
+)
+
+var busyClient = &http.Client{Timeout: 5 * time.Second}
+
+var (
+	protectMu sync.Mutex
+	// Instance addresses from AddressURL, which don't change while an instance lives
+	addresses = map[string]string{}
+	// Protection last wanted in dry run, per ASG and direction, so it is recorded once
+	dryRunWanted = map[string]string{}
+)
+
+// instanceAddress - Address of an instance from AddressURL, cached.
+func (c ProtectionConfig) instanceAddress(id string) (string, error) {
+	protectMu.Lock()
+	address, ok := addresses[id]
+	protectMu.Unlock()
+	if ok {
+		return address, nil
+	}
+	start := time.Now()
+	resp, err := busyClient.Get(withInstanceID(c.AddressURL, id))
+	observeCall("busy", "address", start, err)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("address lookup returned %s", resp.Status)
+	}
+	var body struct {
+		Address string `json:"address"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.Address == "" {
+		return "", fmt.Errorf("no address for instance %s", id)
+	}
+	protectMu.Lock()
+	addresses[id] = body.Address
+	protectMu.Unlock()
+	return body.Address, nil
+}
+
+// withInstanceID - u with ?instance_id=<id> added.
+func withInstanceID(u string, id string) string {
+	if strings.Contains(u, "?") {
+		return u + "&instance_id=" + url.QueryEscape(id)
+	}
+	return u + "?instance_id=" + url.QueryEscape(id)
+}
+
+// busyURL - BusyURL for an instance, placeholders replaced.
+func (c ProtectionConfig) busyURL(asg string, i autoscaling.Instance) (string, error) {
+	u := c.BusyURL
+	if strings.Contains(u, "{address}") {
+		address, err := c.instanceAddress(*i.InstanceId)
+		if err != nil {
+			return "", err
+		}
+		u = strings.Replace(u, "{address}", address, -1)
+	}
+	u = strings.NewReplacer(
+		"{az}", url.PathEscape(*i.AvailabilityZone),
+		"{asg}", url.PathEscape(asg),
+	).Replace(u)
+	if strings.Contains(u, "{instance_id}") {
+		return strings.Replace(u, "{instance_id}", url.PathEscape(*i.InstanceId), -1), nil
+	}
+	return withInstanceID(u, *i.InstanceId), nil
+}
+
+// instanceBusy - Whether BusyURL reports the instance busy.
+func (c ProtectionConfig) instanceBusy(asg string, i autoscaling.Instance) (bool, error) {
+	u, err := c.busyURL(asg, i)
+	if err != nil {
+		return false, err
+	}
+	start := time.Now()
+	resp, err := busyClient.Get(u)
+	observeCall("busy", "check", start, err)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("busy check returned %s", resp.Status)
+	}
+	var body struct {
+		Busy bool `json:"busy"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	return body.Busy, err
+}
+
+// busyCheck Outcome of one instance's busy check
+type busyCheck struct {
+	instance autoscaling.Instance
+	busy     bool
+	err      error
+}
+
+// checkBusy - Busy checks of instances, run concurrently.
+//
+// Checks not answered within busyChecksWithin are left out, so a slow
+// service can't hold up the ASG monitor's poll.
+func checkBusy(asg ASG, instances []autoscaling.Instance) []busyCheck {
+	results := make(chan busyCheck, len(instances))
+	slots := make(chan bool, busyChecksAtOnce)
+	for _, i := range instances {
+		go func(i autoscaling.Instance) {
+			slots <- true
+			defer func() { <-slots }()
+			busy, err := asg.Protection.instanceBusy(asg.AsGroupName, i)
+			results <- busyCheck{instance: i, busy: busy, err: err}
+		}(i)
+	}
+	var checks []busyCheck
+	timeout := time.After(busyChecksWithin)
+	for range instances {
+		select {
+		case r := <-results:
+			checks = append(checks, r)
+		case <-timeout:
+			asg.log().Warn("Busy checks timed out, keeping protection", "answered", len(checks), "instances", len(instances))
+			return checks
+		}
+	}
+	return checks
+}
+
+// protectBusy - Protect busy in-service instances from scale-in, and unprotect idle ones.
+//
+// Instances whose check fails keep their protection. Instances in skip, such
+// as ones being drained, are left alone. c.Instances is updated with the
+// protection set, so instances picked for scale-in this poll are idle.
+func protectBusy(asg ASG, c asgCapacity, skip map[string]time.Time) {
+	log := asg.log()
+	var protect, unprotect []string
+	changed := map[string]bool{}
+	var checked []autoscaling.Instance
+	for _, i := range c.Instances {
+		if _, ok := skip[*i.InstanceId]; ok || i.LifecycleState != autoscaling.LifecycleStateInService {
+			continue
+		}
+		checked = append(checked, i)
+	}
+	for _, r := range checkBusy(asg, checked) {
+		id, busy, i := *r.instance.InstanceId, r.busy, r.instance
+		if r.err != nil {
+			log.Warn("Busy check failed, keeping protection", "instance", id, "err", r.err)
+			continue
+		}
+		protected := i.ProtectedFromScaleIn != nil && *i.ProtectedFromScaleIn
+		if busy && !protected {
+			protect = append(protect, id)
+		} else if !busy && protected {
+			unprotect = append(unprotect, id)
+		}
+	}
+	for _, set := range []struct {
+		ids       []string
+		protected bool
+	}{{protect, true}, {unprotect, false}} {
+		if setProtection(asg, set.ids, set.protected) {
+			for _, id := range set.ids {
+				changed[id] = set.protected
+			}
+		}
+	}
+	for n, i := range c.Instances {
+		if protected, ok := changed[*i.InstanceId]; ok {
+			c.Instances[n].ProtectedFromScaleIn = &protected
+		}
+	}
+}
+
+// setProtection - Set scale-in protection of instances, recording an event.
+//
+// Returns whether the protection was changed, false for a dry run.
+func setProtection(asg ASG, ids []string, protected bool) bool {
+	sort.Strings(ids)
+	log := asg.log()
+	reason := "protect busy"
+	if !protected {
+		reason = "unprotect idle"
+	}
+	e := Event{Type: "asg_protect", Monitor: asg.AsGroupName, ASG: asg.AsGroupName, Reason: reason + " " + strings.Join(ids, ","), ReasonCode: reasonProtect}
+	dryRun := asgDryRun(asg.AsGroupName, asg.AsGroupName)
+	// Nothing changes in a dry run, so the same set is wanted every poll: record it once
+	key := fmt.Sprintf("%s/%t", asg.AsGroupName, protected)
+	protectMu.Lock()
+	repeated := dryRunWanted[key] == e.Reason
+	delete(dryRunWanted, key)
+	if dryRun && len(ids) > 0 {
+		dryRunWanted[key] = e.Reason
+	}
+	protectMu.Unlock()
+	if len(ids) == 0 {
+		return false
+	}
+	if dryRun {
+		if repeated {
+			log.Debug("Dry run, protection still not changed", "protected", protected, "instances", strings.Join(ids, ","))
+			return false
+		}
+		log.Info("Dry run, not changing protection", "protected", protected, "instances", strings.Join(ids, ","))
+		recordEvent(e, true, nil)
+		return false
+	}
+
+	svc := asgClient(asg)
+	for i := 0; i < len(ids); i += protectionBatch {
+		batch := ids[i:clampInt(i+protectionBatch, 0, len(ids))]
+		req := svc.SetInstanceProtectionRequest(&autoscaling.SetInstanceProtectionInput{
+			AutoScalingGroupName: &asg.AsGroupName,
+			InstanceIds:          batch,
+			ProtectedFromScaleIn: &protected,
+		})
+		start := time.Now()
+		_, err := req.Send()
+		externalCall("aws", asg.AWSRegion, "set_instance_protection", start, err)
+		if err != nil {
+			log.Error("Setting instance protection failed", "protected", protected, "instances", strings.Join(batch, ","), "err", err)
+			recordEvent(e, false, err)
+			return false
+		}
+	}
+	log.Info("Instance protection changed", "protected", protected, "instances", strings.Join(ids, ","))
+	recordEvent(e, false, nil)
+	return true
+}
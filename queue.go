@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"net/url"
 	"os"
 	"time"
@@ -13,28 +14,92 @@ import (
 
 func queueRunner() {
 	queues := cfg.Queues
+	grouped := map[string][]Queue{}
 	for _, queue := range queues {
 		switch method := queue.Method; method {
 		case "scale":
+			registerQueue(queue)
+			if queue.Group != "" {
+				grouped[queue.Group] = append(grouped[queue.Group], queue)
+				continue
+			}
 			go scalePods(queue)
 		case "restart":
+			registerQueue(queue)
 			go restartPods(queue)
 		default:
-			Info.Println("Queue Missing/Invalid Method")
+			logger.Warn("Queue Missing/Invalid Method", "monitor", queue.monitorName(), "method", method)
 		}
 	}
+	for _, g := range cfg.Groups {
+		members := grouped[g.Name]
+		delete(grouped, g.Name)
+		for _, q := range members {
+			if q.DeisApp != g.DeisApp {
+				logger.Panic("Queue in group scales a different Deis app", "monitor", q.monitorName(), "group", g.Name)
+			}
+		}
+		configureDryRun(g.Name, g.DryRun)
+		registerMonitor(MonitorStatus{Name: g.Name, Type: "group", Method: "ratio", App: g.DeisApp, Source: "deis"})
+		go scaleGroup(g, members)
+	}
+	for name := range grouped {
+		logger.Panic("Queue refers to undefined group", "group", name)
+	}
 }
 
-func amqConnection(q Queue) *rabbithole.Client {
+// log - Logger carrying the Queue monitor's context, at its LogLevel.
+func (q Queue) log() *Logger {
+	return logger.With("monitor", q.monitorName(), "app", q.DeisApp, "worker", q.Worker, "queue", q.Queue).WithLevel(q.LogLevel)
+}
+
+// registerQueue - Add a Queue monitor to the status board.
+func registerQueue(q Queue) {
+	configureDryRun(q.monitorName(), q.DryRun)
+	registerDependency("rabbitmq", q.AmqHost)
+	// Scaling polls Deis for pod counts, restarting only calls it to restart
+	if q.Method == "scale" || q.Restart.targeted() {
+		registerDependency("deis", "controller")
+	}
+	interval := q.Restart.pollInterval()
+	if q.Method == "scale" {
+		// Idle workers at zero pods may poll less often than 95s
+		interval = q.pollInterval(1)
+		if i := q.pollInterval(0); i > interval {
+			interval = i
+		}
+	}
+	registerMonitor(MonitorStatus{
+		Name:       q.monitorName(),
+		Type:       "queue",
+		Method:     q.Method,
+		App:        q.DeisApp,
+		Worker:     q.Worker,
+		Queue:      q.Queue,
+		Source:     q.AmqHost,
+		Threshold:  q.Threshold,
+		Watermark:  q.Watermark,
+		Min:        q.ScaleMin,
+		Max:        q.ScaleMax,
+		StaleAfter: staleAfter(interval),
+	})
+}
+
+// amqURL - RabbitMQ management URL from the env var named by q's AmqHost, panicking when unset.
+func amqURL(q Queue) *url.URL {
 	amqURL := os.Getenv(q.AmqHost)
 	if amqURL == "" {
-		Warning.Panic("Missing AMQ Environment Variable")
+		logger.Panic("Missing AMQ Environment Variable", "amqhost", q.AmqHost)
 	}
 	u, err := url.Parse(amqURL)
 	if err != nil {
-		Warning.Panic(err)
+		logger.Panic("Unable to Parse AMQ URL", "amqhost", q.AmqHost, "err", err)
 	}
+	return u
+}
 
+func amqConnection(q Queue) *rabbithole.Client {
+	u := amqURL(q)
 	password, _ := u.User.Password()
 	rmqc, _ := rabbithole.NewClient(u.Scheme+"://"+u.Host, u.User.Username(), password)
 
@@ -42,114 +107,313 @@ func amqConnection(q Queue) *rabbithole.Client {
 }
 
 func restartPods(q Queue) {
-	// Setting Last Restart to Now
-	lastRestart := time.Now().Add(-10 * time.Minute)
-	rmqc := amqConnection(q)
+	amq := amqURL(q)
+	health := newConsumerHealth(q.Restart)
+	interval := q.Restart.pollInterval()
+	log := q.log()
 	for {
-		mq, err := rmqc.GetQueue("/", q.Queue)
+		start := time.Now()
+		stats, err := getQueueStats(amq, q)
+		externalCall("rabbitmq", q.AmqHost, "get_queue", start, err)
 		if err != nil {
-			Warning.Printf("Error : %s", err)
-		}
-		Info.Printf("%s = %d\n", q.Queue, mq.Messages)
-
-		if mq.Messages > q.Threshold {
-			// Wait 10 Minutes between restarts
-			now := time.Now()
-			delayInterval := lastRestart.Add(10 * time.Minute)
-			if now.After(delayInterval) {
-				Info.Printf("Queue is over threshold, restarting app %s-%s\n", q.DeisApp, q.Worker)
-				lastRestart = time.Now()
-				deisRestart(q.DeisApp, q.Worker)
+			monitorPolled(q.monitorName(), 0, 0, err)
+			log.Error("Queue lookup failed", "err", err)
+			time.Sleep(interval)
+			continue
+		}
+		log.Debug("Polled queue", "messages", stats.Messages, "consumers", stats.Consumers, "ack_rate", stats.AckRate)
+		monitorPolled(q.monitorName(), stats.Messages, 0, nil)
+		if monitorPaused(q.monitorName()) {
+			monitorDecided(q.monitorName(), "paused")
+			time.Sleep(interval)
+			continue
+		}
+		if inhibitedDecision(q.monitorName(), log) {
+			time.Sleep(interval)
+			continue
+		}
+		if restartRunning(q.DeisApp, q.Worker) {
+			monitorDecided(q.monitorName(), "restart in progress")
+			time.Sleep(interval)
+			continue
+		}
+
+		decision := "consumers healthy"
+		if reason := health.stuck(q, stats); reason != "" {
+			if ok, why := health.allowed(); ok {
+				log.Info("Consumers stuck, restarting", "reason", reason, "messages", stats.Messages, "consumers", stats.Consumers)
+				decision = "restart, " + reason
+				health.restarted()
+				e := queueEvent(q, stats.Messages, 0, reasonStuck, reason)
+				startRestart(q.DeisApp, q.Worker, func() { deisRestart(q.DeisApp, q.Worker, q.Restart, e) })
 			} else {
-				Info.Printf("Queue is over threshold, but within cool down period for app %s-%s\n", q.DeisApp, q.Worker)
+				log.Info("Consumers stuck, but not restarting", "reason", reason, "why", why, "messages", stats.Messages)
+				decision = reason + ", " + why
 			}
+		} else if q.Restart.targeted() {
+			decision = restartTargeted(q, health, stats, log)
+		}
+		monitorDecided(q.monitorName(), decision)
+		time.Sleep(interval)
+	}
+}
+
+// restartTargeted - Restart the single pods picked by q's restart policies, returning the decision.
+func restartTargeted(q Queue, health *consumerHealth, stats queueStats, log *Logger) string {
+	pods, err := deisWorkerPods(q.DeisApp, q.Worker)
+	if err != nil {
+		log.Error("Deis unable to list pods", "err", err)
+		return "consumers healthy, unable to list pods"
+	}
+	picked, reason := pickPods(q.Restart, pods, stats)
+	if len(picked) == 0 {
+		return "consumers healthy"
+	}
+	if ok, why := health.allowed(); !ok {
+		log.Info("Pods picked for restart, but not restarting", "reason", reason, "pods", len(picked), "why", why)
+		return reason + ", " + why
+	}
+	log.Info("Restarting picked pods", "reason", reason, "pods", len(picked))
+	health.restarted()
+	e := queueEvent(q, stats.Messages, 0, reasonUnhealthyPods, reason)
+	startRestart(q.DeisApp, q.Worker, func() { deisRestartSelected(q.DeisApp, q.Worker, picked, q.Restart, e) })
+	return fmt.Sprintf("restart %d pods, %s", len(picked), reason)
+}
+
+// queueScaler Decision state of a scaling Queue monitor, kept across polls
+type queueScaler struct {
+	q         Queue
+	log       *Logger
+	stab      *stabilizer
+	limiter   *rateLimiter
+	guard     *rangeGuard
+	schedules []compiledSchedule
+	pred      *predictor
+	idle      *idleTracker
+}
+
+func newQueueScaler(q Queue) *queueScaler {
+	return &queueScaler{
+		q:         q,
+		log:       q.log(),
+		stab:      newStabilizer(q.StabilizationWindow),
+		limiter:   newRateLimiter(q.ScaleUp, q.ScaleDown),
+		guard:     &rangeGuard{},
+		schedules: compileSchedules(q.monitorName(), q.Schedules),
+		pred:      newPredictor(q.monitorName(), q.Predict, cfg.History),
+		idle:      &idleTracker{},
+	}
+}
+
+// decide - Pod count the monitor wants this poll, why, and its reason code.
+func (s *queueScaler) decide(messages int, podcount int) (int, string, string) {
+	q, log := s.q, s.log
+
+	// Scheduled limits replace ScaleMin/ScaleMax for this cycle
+	lim := scheduledLimits(s.schedules, Limits{Min: q.ScaleMin, Max: q.ScaleMax}, time.Now())
+	sq := q
+	sq.ScaleMin, sq.ScaleMax = lim.Min, lim.Max
+	updateMonitor(q.monitorName(), func(m *MonitorStatus) {
+		m.Min, m.Max = lim.Min, lim.Max
+	})
 
+	s.pred.observe(messages)
+	signal, predicted := s.pred.signal(messages)
+	desired, reason, code := queueRecommendation(sq, signal, podcount)
+	if predicted {
+		log.Debug("Deciding on predicted depth", "messages", messages, "predicted", signal)
+		reason, code = "predicted "+reason, reasonPredicted
+	}
+	if lim.Pinned {
+		desired, reason, code = lim.Replicas, "pinned by schedule "+lim.Schedule, reasonSchedule
+	} else if pods, why, ok := s.idle.decide(sq, messages, podcount); ok {
+		desired, reason, code = pods, why, reasonIdle
+	} else if scheduled := clampInt(podcount, lim.Min, lim.Max); lim.Schedule != "" && scheduled != podcount {
+		log.Info("Outside of scheduled limits, correcting", "pods", podcount, "schedule", lim.Schedule, "min", lim.Min, "max", lim.Max)
+		desired, reason, code = scheduled, "outside limits of schedule "+lim.Schedule, reasonSchedule
+	} else if corrected, why := s.guard.correct(sq, podcount); why != "" {
+		log.Info("Outside of Min/Max Pod Settings, correcting", "pods", podcount, "scalemin", q.ScaleMin, "scalemax", q.ScaleMax, "desired", corrected)
+		desired, reason, code = corrected, why, reasonOutOfRange
+	} else {
+		if stabilized := s.stab.stabilize(podcount, desired); stabilized != desired {
+			log.Debug("Under watermark, holding scale down for stabilization window", "pods", podcount, "recommended", desired, "stabilized", stabilized)
+			desired, reason = stabilized, "under watermark, stabilizing"
+		}
+		if limited, policy := s.limiter.limit(podcount, desired); policy != "" {
+			log.Info("Scale clamped by policy", "pods", podcount, "recommended", desired, "allowed", limited, "policy", policy)
+			desired, reason = limited, reason+", clamped by policy "+policy
+		}
+		if desired != podcount {
+			s.limiter.record(desired - podcount)
 		}
-		time.Sleep(101 * time.Second)
 	}
+	return desired, reason, code
+}
+
+// report - Log a decision and return its status board description.
+func (s *queueScaler) report(messages int, podcount int, desired int, reason string, code string) string {
+	q, log := s.q, s.log
+	switch {
+	case desired > podcount:
+		log.Info("Scaling up", "messages", messages, "pods", podcount, "desired", desired, "reason", reason)
+		return fmt.Sprintf("scale up to %d", desired)
+	case desired < podcount:
+		log.Info("Scaling down", "messages", messages, "pods", podcount, "desired", desired, "reason", reason)
+		return fmt.Sprintf("scale down to %d", desired)
+	case code == reasonOutOfRange:
+		log.Warn("Outside of Min/Max Pod Settings", "messages", messages, "pods", podcount, "scalemin", q.ScaleMin, "scalemax", q.ScaleMax)
+	default:
+		log.Debug("No change", "messages", messages, "pods", podcount, "reason", reason)
+	}
+	return reason
 }
 
 func scalePods(q Queue) {
 	rmqc := amqConnection(q)
+	log := q.log()
+	scaler := newQueueScaler(q)
 	for {
 		// Need to handle timeouts...
+		start := time.Now()
 		mq, err := rmqc.GetQueue("/", q.Queue)
+		externalCall("rabbitmq", q.AmqHost, "get_queue", start, err)
 		if err != nil {
-			Warning.Printf("Error : %s", err)
-		}
-		Info.Printf("%s = %d\n", q.Queue, mq.Messages)
-		podcount := deisPodCount(q.DeisApp, q.Worker)
-		podScaleEvent.With(prometheus.Labels{"service": q.DeisApp + "-" + q.Worker, "status": "success"}).Set(float64(podcount))
-
-		if mq.Messages >= q.Threshold {
-			desiredPodCount := podcount + q.ScaleBy
-			if podcount < q.ScaleMin || podcount > q.ScaleMax {
-				Info.Printf("%s is outside of Min/Max Pod Settings, Change back inside range %d - %d", q.DeisApp+"-"+q.Worker, q.ScaleMin, q.ScaleMax)
-			} else if desiredPodCount > q.ScaleMax {
-				Info.Printf("%s over threshold, scaling to Maximum %d\n", q.DeisApp+"-"+q.Worker, q.ScaleMax)
-				deisScale(q.DeisApp, q.Worker, q.ScaleMax)
-			} else {
-				Info.Printf("%s over threshold, scaling to %d from %d(+%d)\n", q.DeisApp+"-"+q.Worker, desiredPodCount, podcount, q.ScaleBy)
-				deisScale(q.DeisApp, q.Worker, desiredPodCount)
-			}
+			monitorPolled(q.monitorName(), 0, 0, err)
+			log.Error("Queue lookup failed", "err", err)
+			time.Sleep(95 * time.Second)
+			continue
 		}
-		if mq.Messages < q.Watermark {
-			if podcount == q.ScaleMin {
-				Info.Printf("%s is at minimum(%d) Pods defined by ScaleMin", q.DeisApp+"-"+q.Worker, podcount)
-			} else if podcount < q.ScaleMin || podcount > q.ScaleMax {
-				Info.Printf("%s is outside of Min/Max Pod Settings, Change back inside range %d - %d", q.DeisApp+"-"+q.Worker, q.ScaleMin, q.ScaleMax)
-			} else if podcount > q.ScaleMin {
-				desiredPodCount := podcount - 1
-				Info.Printf("%s under Watermark, scale down to %d from %d(-1)\n", q.DeisApp+"-"+q.Worker, desiredPodCount, podcount)
-				deisScale(q.DeisApp, q.Worker, desiredPodCount)
-			}
+		podcount, err := deisPodCount(q.DeisApp, q.Worker)
+		if err != nil {
+			monitorPolled(q.monitorName(), mq.Messages, 0, err)
+			log.Error("Deis unable to list pods", "err", err)
+			time.Sleep(95 * time.Second)
+			continue
+		}
+		monitorPolled(q.monitorName(), mq.Messages, podcount, nil)
+		log.Debug("Polled queue", "messages", mq.Messages, "pods", podcount)
+		podScaleEvent.With(prometheus.Labels{"service": q.monitorName(), "status": "success"}).Set(float64(podcount))
+		if queueControlled(q, mq.Messages, podcount) {
+			time.Sleep(95 * time.Second)
+			continue
+		}
+
+		desired, reason, code := scaler.decide(mq.Messages, podcount)
+		if desired != podcount {
+			deisScale(q.DeisApp, q.Worker, desired, queueEvent(q, mq.Messages, podcount, code, reason))
 		}
+		monitorDecided(q.monitorName(), scaler.report(mq.Messages, podcount, desired, reason, code))
+
+		time.Sleep(q.pollInterval(desired))
+	}
+}
+
+// queueControlled - Apply pause or override from the control API, true if handled.
+func queueControlled(q Queue, messages int, podcount int) bool {
+	name := q.monitorName()
+	if monitorPaused(name) {
+		monitorDecided(name, "paused")
+		return true
+	}
+	if inhibitedDecision(name, q.log()) {
+		return true
+	}
+	replicas, ok := monitorOverride(name)
+	if !ok {
+		return false
+	}
+	if podcount != replicas {
+		q.log().Info("Overridden, scaling", "pods", podcount, "desired", replicas)
+		deisScale(q.DeisApp, q.Worker, replicas, queueEvent(q, messages, podcount, reasonOverride, "override"))
+	}
+	monitorDecided(name, fmt.Sprintf("override to %d", replicas))
+	return true
+}
 
-		time.Sleep(95 * time.Second)
+// queueEvent - Event template for an action taken by a Queue monitor.
+func queueEvent(q Queue, signal int, current int, code string, reason string) Event {
+	return Event{
+		Monitor:     q.monitorName(),
+		Signal:      signal,
+		OldReplicas: current,
+		Reason:      reason,
+		ReasonCode:  code,
 	}
 }
 
-func deisPodCount(app string, worker string) int {
+// deisPodCounts - Pods of every process type of app.
+func deisPodCounts(app string) (map[string]int, error) {
 	// Verify SSL, Controller URL, API Token
+	start := time.Now()
 	podlist, _, err := deisps.List(deiscfg.Client, app, 0)
+	externalCall("deis", "controller", "list_pods", start, err)
 	if err != nil {
-		Warning.Panic(err)
+		return nil, err
 	}
-	var workercount int
-	podtypes := deisps.ByType(podlist)
-	for _, pt := range podtypes {
-		if pt.Type == worker {
-			workercount = pt.PodsList.Len()
-		}
+	counts := map[string]int{}
+	for _, pt := range deisps.ByType(podlist) {
+		counts[pt.Type] = pt.PodsList.Len()
 	}
-	return workercount
+	return counts, nil
 }
 
-func deisScale(app string, worker string, desired int) {
-	if cfg.Enabled {
-		targets := make(map[string]int)
-		targets[worker] = desired
-		err := deisps.Scale(deiscfg.Client, app, targets)
-		if err != nil {
-			podScaleEvent.With(prometheus.Labels{"service": app + "-" + worker, "status": "failed"}).Set(float64(desired))
-			Info.Println("Error: Deis unable to process scale event", err)
-		} else {
-			workerCount := deisPodCount(app, worker)
-			podScaleEvent.With(prometheus.Labels{"service": app + "-" + worker, "status": "success"}).Set(float64(desired))
-			Info.Printf("%s pod count now %d\n", app+"-"+worker, workerCount)
-		}
+func deisPodCount(app string, worker string) (int, error) {
+	counts, err := deisPodCounts(app)
+	if err != nil {
+		return 0, err
 	}
+	return counts[worker], nil
 }
 
-func deisRestart(app string, worker string) {
-	if cfg.Enabled {
-		_, err := deisps.Restart(deiscfg.Client, app, worker, "")
-		if err != nil {
-			serviceRestart.With(prometheus.Labels{"service": app + "-" + worker, "status": "failed"}).Inc()
-			Info.Println("Deis unable to restart process event", err)
-		} else {
-			serviceRestart.With(prometheus.Labels{"service": app + "-" + worker, "status": "success"}).Inc()
-			Info.Printf("%s Services Restarted\n", app+"-"+worker)
+func deisScale(app string, worker string, desired int, e Event) {
+	e.Worker = worker
+	deisScaleTargets(app, map[string]int{worker: desired}, []Event{e})
+}
+
+// deisScaleTargets - Scale several process types of app in one controller call.
+//
+// events holds one Event per target, matched on Worker.
+func deisScaleTargets(app string, targets map[string]int, events []Event) {
+	for i := range events {
+		events[i].Type = "scale"
+		events[i].App = app
+		events[i].NewReplicas = targets[events[i].Worker]
+	}
+	live := map[string]int{}
+	var liveEvents []Event
+	for _, e := range events {
+		if monitorDryRun(e.Monitor) {
+			logger.Info("Dry run, not scaling", "monitor", e.Monitor, "app", app, "worker", e.Worker, "desired", e.NewReplicas)
+			recordEvent(e, true, nil)
+			continue
 		}
+		live[e.Worker] = targets[e.Worker]
+		liveEvents = append(liveEvents, e)
+	}
+	if len(live) == 0 {
+		return
+	}
+	targets, events = live, liveEvents
+
+	start := time.Now()
+	err := deisps.Scale(deiscfg.Client, app, targets)
+	externalCall("deis", "controller", "scale", start, err)
+	for _, e := range events {
+		recordEvent(e, false, err)
+	}
+	if err != nil {
+		for worker, desired := range targets {
+			podScaleEvent.With(prometheus.Labels{"service": app + "-" + worker, "status": "failed"}).Set(float64(desired))
+		}
+		logger.Error("Deis unable to process scale event", "app", app, "targets", fmt.Sprint(targets), "err", err)
+		return
+	}
+	counts, err := deisPodCounts(app)
+	if err != nil {
+		logger.Warn("Deis scaled, unable to list pods", "app", app, "err", err)
+	}
+	for worker, desired := range targets {
+		podScaleEvent.With(prometheus.Labels{"service": app + "-" + worker, "status": "success"}).Set(float64(desired))
+		logger.Info("Deis scaled", "app", app, "worker", worker, "pods", counts[worker])
 	}
 }
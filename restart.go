@@ -0,0 +1,440 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/jsonparser"
+	rabbithole "github.com/michaelklishin/rabbit-hole"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/deis/controller-sdk-go/api"
+	deisps "github.com/deis/controller-sdk-go/ps"
+)
+
+// RestartConfig Consumer health checks of a restart Queue monitor
+//
+// A worker is only restarted on evidence its consumers are stuck: the queue
+// stays over Threshold with no acks for StuckFor seconds, or the number of
+// consumers drops while it is over Threshold.
+type RestartConfig struct {
+	// Seconds over Threshold with a zero ack rate before restarting, default 300
+	StuckFor int
+	// Restart when the consumer count drops, default off
+	ConsumerDrop bool
+	// Seconds between restarts, default 600
+	Cooldown int
+	// Seconds between polls, default 101
+	PollInterval int
+	// Restarts allowed in any hour, 0 is unlimited
+	MaxPerHour int
+	// all (default) restarts the whole process type at once, rolling a few pods at a time
+	Mode string
+	// Pods restarted at once in rolling mode, default 1
+	MaxUnavailable int
+	// Seconds to wait for restarted pods to be up, default 300
+	ReadyTimeout int
+	// Also restart single pods: crashed or errored ones, ones older than MaxAge
+	// seconds, and ones without a consumer on the queue for StuckFor seconds
+	Crashed         bool
+	MaxAge          int
+	MissingConsumer bool
+}
+
+// stuckFor - Time without acks before consumers count as stuck.
+func (c RestartConfig) stuckFor() time.Duration {
+	if c.StuckFor > 0 {
+		return time.Duration(c.StuckFor) * time.Second
+	}
+	return 300 * time.Second
+}
+
+// cooldown - Minimum time between restarts.
+func (c RestartConfig) cooldown() time.Duration {
+	if c.Cooldown > 0 {
+		return time.Duration(c.Cooldown) * time.Second
+	}
+	return 10 * time.Minute
+}
+
+// pollInterval - Time between polls.
+func (c RestartConfig) pollInterval() time.Duration {
+	if c.PollInterval > 0 {
+		return time.Duration(c.PollInterval) * time.Second
+	}
+	return 101 * time.Second
+}
+
+// rolling - Whether pods are restarted a few at a time.
+func (c RestartConfig) rolling() bool {
+	return c.Mode == "rolling"
+}
+
+// maxUnavailable - Pods restarted at once in rolling mode.
+func (c RestartConfig) maxUnavailable() int {
+	if c.MaxUnavailable > 0 {
+		return c.MaxUnavailable
+	}
+	return 1
+}
+
+// readyTimeout - Time restarted pods have to come back up.
+func (c RestartConfig) readyTimeout() time.Duration {
+	if c.ReadyTimeout > 0 {
+		return time.Duration(c.ReadyTimeout) * time.Second
+	}
+	return 5 * time.Minute
+}
+
+// targeted - Whether single pods are picked for restart.
+func (c RestartConfig) targeted() bool {
+	return c.Crashed || c.MaxAge > 0 || c.MissingConsumer
+}
+
+// restartConfigOf - Restart settings of the Queue or Alert monitor called name.
+func restartConfigOf(name string) RestartConfig {
+	for _, q := range cfg.Queues {
+		if q.monitorName() == name {
+			return q.Restart
+		}
+	}
+	for _, a := range cfg.Alerts {
+		if a.Name == name {
+			return a.Restart
+		}
+	}
+	return RestartConfig{}
+}
+
+// queueStats Queue figures a restart decision is based on
+type queueStats struct {
+	Messages  int
+	Consumers int
+	AckRate   float64
+	// AMQP connection names of the queue's consumers
+	Connections []string
+}
+
+// A hung management API must not stall the restart monitor
+var statsClient = &http.Client{Timeout: 30 * time.Second}
+
+// getQueueStats - Depth, consumers and ack rate of q's queue, from the management API at u.
+//
+// rabbit-hole's QueueInfo has no ack figures, so the management API is read
+// directly. RabbitMQ leaves message_stats out of a queue with no recent
+// activity, which counts as a zero ack rate.
+func getQueueStats(u *url.URL, q Queue) (queueStats, error) {
+	req, err := http.NewRequest("GET", u.Scheme+"://"+u.Host+"/api/queues/%2F/"+rabbithole.PathEscape(q.Queue), nil)
+	if err != nil {
+		return queueStats{}, err
+	}
+	password, _ := u.User.Password()
+	req.SetBasicAuth(u.User.Username(), password)
+	resp, err := statsClient.Do(req)
+	if err != nil {
+		return queueStats{}, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return queueStats{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return queueStats{}, fmt.Errorf("rabbitmq returned %s", resp.Status)
+	}
+
+	var s queueStats
+	messages, err := jsonparser.GetInt(body, "messages")
+	if err != nil {
+		return queueStats{}, err
+	}
+	consumers, _ := jsonparser.GetInt(body, "consumers")
+	s.Messages, s.Consumers = int(messages), int(consumers)
+	s.AckRate, _ = jsonparser.GetFloat(body, "message_stats", "ack_details", "rate")
+	jsonparser.ArrayEach(body, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
+		if name, err := jsonparser.GetString(value, "channel_details", "connection_name"); err == nil {
+			s.Connections = append(s.Connections, name)
+		}
+	}, "consumer_details")
+	return s, nil
+}
+
+// consumerHealth Tracks evidence of stuck consumers and recent restarts of a Queue monitor
+type consumerHealth struct {
+	cfg           RestartConfig
+	stalledSince  time.Time
+	lastConsumers int
+	restarts      []time.Time
+}
+
+func newConsumerHealth(c RestartConfig) *consumerHealth {
+	return &consumerHealth{cfg: c, lastConsumers: -1}
+}
+
+// stuck - Why the consumers look stuck, empty when they are making progress.
+func (h *consumerHealth) stuck(q Queue, s queueStats) string {
+	dropped := h.lastConsumers >= 0 && s.Consumers < h.lastConsumers
+	h.lastConsumers = s.Consumers
+	if s.Messages <= q.Threshold {
+		h.stalledSince = time.Time{}
+		return ""
+	}
+	if h.cfg.ConsumerDrop && dropped {
+		return "consumers dropped"
+	}
+	if s.AckRate > 0 {
+		h.stalledSince = time.Time{}
+		return ""
+	}
+	if h.stalledSince.IsZero() {
+		h.stalledSince = time.Now()
+	}
+	if time.Since(h.stalledSince) >= h.cfg.stuckFor() {
+		return "no acks with backlog"
+	}
+	return ""
+}
+
+// allowed - Whether a restart may happen now, and why not.
+func (h *consumerHealth) allowed() (bool, string) {
+	now := time.Now()
+	kept := h.restarts[:0]
+	for _, t := range h.restarts {
+		if now.Sub(t) < time.Hour {
+			kept = append(kept, t)
+		}
+	}
+	h.restarts = kept
+	if n := len(h.restarts); n > 0 && now.Sub(h.restarts[n-1]) < h.cfg.cooldown() {
+		return false, "in cool down"
+	}
+	if h.cfg.MaxPerHour > 0 && len(h.restarts) >= h.cfg.MaxPerHour {
+		return false, "hourly restart limit reached"
+	}
+	return true, ""
+}
+
+// restarted - Remember a restart, starting the stall clock over.
+func (h *consumerHealth) restarted() {
+	h.restarts = append(h.restarts, time.Now())
+	h.stalledSince = time.Time{}
+}
+
+var (
+	restartMu  sync.Mutex
+	restarting = map[string]bool{}
+)
+
+// startRestart - Run restart of app's worker in the background, false if one is still running.
+//
+// Rolling restarts wait minutes for pods to come back, which must not hold up
+// the monitor's polling or the API call that asked for it. Queue monitors,
+// alert rules and the API all restart through here, so they never overlap.
+func startRestart(app string, worker string, restart func()) bool {
+	key := app + "-" + worker
+	restartMu.Lock()
+	defer restartMu.Unlock()
+	if restarting[key] {
+		return false
+	}
+	restarting[key] = true
+	go func() {
+		defer func() {
+			restartMu.Lock()
+			delete(restarting, key)
+			restartMu.Unlock()
+		}()
+		restart()
+	}()
+	return true
+}
+
+// restartRunning - Whether a restart of app's worker is still running.
+func restartRunning(app string, worker string) bool {
+	restartMu.Lock()
+	defer restartMu.Unlock()
+	return restarting[app+"-"+worker]
+}
+
+// deisRestart - Restart app's worker pods, all at once or rolling per rc.Mode.
+func deisRestart(app string, worker string, rc RestartConfig, e Event) {
+	e.Type = "restart"
+	e.App, e.Worker = app, worker
+	if monitorDryRun(e.Monitor) {
+		logger.Info("Dry run, not restarting", "monitor", e.Monitor, "app", app, "worker", worker)
+		recordEvent(e, true, nil)
+		return
+	}
+
+	var err error
+	if rc.rolling() {
+		var pods api.PodsList
+		if pods, err = deisWorkerPods(app, worker); err == nil {
+			e.OldReplicas = len(pods)
+			err = deisRestartPods(app, worker, pods, rc)
+		}
+	} else {
+		start := time.Now()
+		_, err = deisps.Restart(deiscfg.Client, app, worker, "")
+		externalCall("deis", "controller", "restart", start, err)
+	}
+	recordEvent(e, false, err)
+	if err != nil {
+		serviceRestart.With(prometheus.Labels{"service": app + "-" + worker, "status": "failed"}).Inc()
+		logger.Error("Deis unable to restart process", "app", app, "worker", worker, "err", err)
+	} else {
+		serviceRestart.With(prometheus.Labels{"service": app + "-" + worker, "status": "success"}).Inc()
+		logger.Info("Deis restarted process", "app", app, "worker", worker, "rolling", rc.rolling())
+	}
+}
+
+// pickPods - Pods of a worker the targeted restart policies select, and why.
+//
+// A pod's consumer is found by its name appearing in a consumer's AMQP
+// connection name, so workers must name their connections after their hostname.
+func pickPods(rc RestartConfig, pods api.PodsList, s queueStats) (api.PodsList, string) {
+	var picked api.PodsList
+	reasons := map[string]bool{}
+	for _, p := range pods {
+		reason := ""
+		// Pods without a start time are never considered old
+		var age time.Duration
+		if p.Started.Time != nil {
+			age = time.Since(*p.Started.Time)
+		}
+		switch {
+		case rc.Crashed && (strings.EqualFold(p.State, "crashed") || strings.EqualFold(p.State, "error")):
+			reason = "pod " + strings.ToLower(p.State)
+		case rc.MaxAge > 0 && age > time.Duration(rc.MaxAge)*time.Second:
+			reason = "pod over max age"
+		case rc.MissingConsumer && p.State == "up" && age > rc.stuckFor() && !hasConsumer(p.Name, s.Connections):
+			reason = "pod without consumer"
+		}
+		if reason != "" {
+			picked = append(picked, p)
+			reasons[reason] = true
+		}
+	}
+	var why []string
+	for r := range reasons {
+		why = append(why, r)
+	}
+	sort.Strings(why)
+	return picked, strings.Join(why, ", ")
+}
+
+func hasConsumer(pod string, connections []string) bool {
+	for _, c := range connections {
+		if strings.Contains(c, pod) {
+			return true
+		}
+	}
+	return false
+}
+
+// deisRestartSelected - Restart only the given pods of app's worker.
+func deisRestartSelected(app string, worker string, pods api.PodsList, rc RestartConfig, e Event) {
+	e.Type = "restart"
+	e.App, e.Worker = app, worker
+	e.OldReplicas = len(pods)
+	var names []string
+	for _, p := range pods {
+		names = append(names, p.Name)
+	}
+	if monitorDryRun(e.Monitor) {
+		logger.Info("Dry run, not restarting pods", "monitor", e.Monitor, "app", app, "worker", worker, "pods", strings.Join(names, ","))
+		recordEvent(e, true, nil)
+		return
+	}
+	err := deisRestartPods(app, worker, pods, rc)
+	recordEvent(e, false, err)
+	if err != nil {
+		serviceRestart.With(prometheus.Labels{"service": app + "-" + worker, "status": "failed"}).Inc()
+		logger.Error("Deis unable to restart pods", "app", app, "worker", worker, "pods", strings.Join(names, ","), "err", err)
+	} else {
+		serviceRestart.With(prometheus.Labels{"service": app + "-" + worker, "status": "success"}).Inc()
+		logger.Info("Deis restarted pods", "app", app, "worker", worker, "pods", strings.Join(names, ","))
+	}
+}
+
+// deisWorkerPods - Pods of app's worker process type.
+func deisWorkerPods(app string, worker string) (api.PodsList, error) {
+	start := time.Now()
+	podlist, _, err := deisps.List(deiscfg.Client, app, 0)
+	externalCall("deis", "controller", "list_pods", start, err)
+	if err != nil {
+		return nil, err
+	}
+	var pods api.PodsList
+	for _, p := range podlist {
+		if p.Type == worker {
+			pods = append(pods, p)
+		}
+	}
+	return pods, nil
+}
+
+// deisRestartPods - Restart pods by name, rc.MaxUnavailable at a time.
+//
+// Each batch must be back up before the next starts, so at most MaxUnavailable
+// pods are down at once. Stops at the first failure or timeout.
+func deisRestartPods(app string, worker string, pods api.PodsList, rc RestartConfig) error {
+	current, err := deisWorkerPods(app, worker)
+	if err != nil {
+		return err
+	}
+	restarted := map[string]bool{}
+	for i := 0; i < len(pods); i += rc.maxUnavailable() {
+		batch := pods[i:clampInt(i+rc.maxUnavailable(), 0, len(pods))]
+		for _, p := range batch {
+			start := time.Now()
+			_, err := deisps.Restart(deiscfg.Client, app, worker, p.Name)
+			externalCall("deis", "controller", "restart_pod", start, err)
+			if err != nil {
+				return fmt.Errorf("restarting pod %s: %v", p.Name, err)
+			}
+			logger.Debug("Restarted pod", "app", app, "worker", worker, "pod", p.Name)
+			restarted[p.Name] = true
+		}
+		// Pods up before, plus replacements of every pod restarted so far
+		count := 0
+		for _, p := range current {
+			if p.State == "up" || restarted[p.Name] {
+				count++
+			}
+		}
+		if err := waitPodsUp(app, worker, count, restarted, rc.readyTimeout()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitPodsUp - Wait until the restarted pods are gone and count pods of worker are up.
+func waitPodsUp(app string, worker string, count int, restarted map[string]bool, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		time.Sleep(5 * time.Second)
+		pods, err := deisWorkerPods(app, worker)
+		if err == nil {
+			up := 0
+			for _, p := range pods {
+				if p.State == "up" && !restarted[p.Name] {
+					up++
+				}
+			}
+			if up >= count {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("pods of %s not up after %s", worker, timeout)
+		}
+	}
+}
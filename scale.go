@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"net/url"
 	"os"
 	"time"
@@ -18,81 +19,181 @@ func scaleRunner() {
 	for _, asg := range asg {
 		switch method := asg.Method; method {
 		case "scale":
-			Info.Println("scale method firing")
-			scaleCluster(asg)
+			configureDryRun(asg.AsGroupName, asg.DryRun || !asg.Enabled)
+			registerMonitor(MonitorStatus{
+				Name:      asg.AsGroupName,
+				Type:      "asg",
+				Method:    asg.Method,
+				ASG:       asg.AsGroupName,
+				Queue:     asg.Queue,
+				Source:    asg.AmqHost,
+				Threshold: asg.Threshold,
+				Watermark: asg.Watermark,
+			})
+			registerDependency("rabbitmq", asg.AmqHost)
+			registerDependency("aws", asg.AWSRegion)
+			go scaleCluster(asg)
 		default:
-			Info.Println("Nothing to do")
+			logger.Warn("ASG Missing/Invalid Method", "monitor", asg.AsGroupName, "method", method)
 		}
 	}
 }
 
+// Default ASG step sizes, overridden by ScaleUpBy/ScaleDownBy
 var (
 	scaleUpBy   = 4
 	scaleDownBy = 2
-	asgDesired  int
-	asgMin      int
-	asgMax      int
 )
 
+// asgCapacity Current desired, min and max size of an AutoScaling Group
+type asgCapacity struct {
+	Desired   int
+	Min       int
+	Max       int
+	Instances []autoscaling.Instance
+}
+
+// log - Logger carrying the ASG monitor's context, at its LogLevel.
+func (asg ASG) log() *Logger {
+	return logger.With("monitor", asg.AsGroupName, "asg", asg.AsGroupName, "queue", asg.Queue).WithLevel(asg.LogLevel)
+}
+
 func scaleCluster(asg ASG) {
+	log := asg.log()
+	stab := newStabilizer(asg.StabilizationWindow)
+	limiter := newRateLimiter(asg.ScaleUp, asg.ScaleDown)
+	schedules := compileSchedules(asg.AsGroupName, asg.Schedules)
+	pred := newPredictor(asg.AsGroupName, asg.Predict, cfg.History)
+	var drain *drainer
+	if asg.ScaleIn.Mode == "drain" {
+		drain = newDrainer(asg)
+	}
 	for {
-		asgDesired, asgMin, asgMax = getAutoScaleDesired(asg)
+		c, err := getAutoScaleDesired(asg)
+		if err != nil {
+			monitorPolled(asg.AsGroupName, 0, 0, err)
+			time.Sleep(95 * time.Second)
+			continue
+		}
+		if asg.Protection.BusyURL != "" && !monitorPaused(asg.AsGroupName) {
+			var draining map[string]time.Time
+			if drain != nil {
+				draining = drain.drainingSince()
+			}
+			protectBusy(asg, c, draining)
+		}
+		if drain != nil {
+			if !monitorPaused(asg.AsGroupName) && len(monitorInhibited(asg.AsGroupName)) == 0 {
+				c.Desired -= drain.progress(c)
+			}
+			// Decide on the capacity left once draining instances are gone
+			c.Desired -= drain.pending()
+		}
 		// Report current count to prometheus exporter
-		promASGcount.With(prometheus.Labels{"name": asg.AsGroupName}).Set(float64(asgDesired))
+		promASGcount.With(prometheus.Labels{"name": asg.AsGroupName}).Set(float64(c.Desired))
 
 		rmqc := amqScaleConnection(asg)
 		// Need to handle timeouts...
+		start := time.Now()
 		mq, err := rmqc.GetQueue("/", asg.Queue)
+		externalCall("rabbitmq", asg.AmqHost, "get_queue", start, err)
 		if err != nil {
-			Warning.Printf("Error : %s", err)
+			monitorPolled(asg.AsGroupName, 0, c.Desired, err)
+			log.Error("Queue lookup failed", "err", err)
+			time.Sleep(95 * time.Second)
+			continue
 		}
-		Info.Printf("%s = %d\n", asg.Queue, mq.Messages)
+		// Scheduled limits narrow the group's own min/max for this cycle
+		lim := scheduledLimits(schedules, Limits{Min: c.Min, Max: c.Max}, time.Now())
+		groupMin, groupMax := c.Min, c.Max
+		c.Min, c.Max = clampInt(lim.Min, groupMin, groupMax), clampInt(lim.Max, groupMin, groupMax)
+		updateMonitor(asg.AsGroupName, func(s *MonitorStatus) {
+			s.Min, s.Max = c.Min, c.Max
+		})
+		monitorPolled(asg.AsGroupName, mq.Messages, c.Desired, nil)
 
-		if mq.Messages < asg.Watermark {
-			scaleDown(asg)
-		} else if mq.Messages >= asg.Threshold {
-			scaleUp(asg)
+		if asgControlled(asg, drain, c, mq.Messages) {
+			log.Debug("Under runtime control")
+			time.Sleep(95 * time.Second)
+			continue
+		}
+
+		pred.observe(mq.Messages)
+		signal, predicted := pred.signal(mq.Messages)
+		desired, reason, code := asgRecommendation(asg, c, signal)
+		if predicted {
+			log.Debug("Deciding on predicted depth", "messages", mq.Messages, "predicted", signal)
+			reason, code = "predicted "+reason, reasonPredicted
+		}
+		if lim.Pinned {
+			desired, reason, code = clampInt(lim.Replicas, groupMin, groupMax), "pinned by schedule "+lim.Schedule, reasonSchedule
+		} else if scheduled := clampInt(c.Desired, c.Min, c.Max); lim.Schedule != "" && scheduled != c.Desired {
+			log.Info("Outside of scheduled limits, correcting", "desired", c.Desired, "schedule", lim.Schedule, "min", c.Min, "max", c.Max)
+			desired, reason, code = scheduled, "outside limits of schedule "+lim.Schedule, reasonSchedule
 		} else {
-			Info.Printf("Queue within normal range, doing nothing\n")
+			if stabilized := stab.stabilize(c.Desired, desired); stabilized != desired {
+				log.Debug("Under watermark, holding scale down for stabilization window", "desired", c.Desired, "recommended", desired, "stabilized", stabilized)
+				desired, reason = stabilized, "under watermark, stabilizing"
+			}
+			if limited, policy := limiter.limit(c.Desired, desired); policy != "" {
+				log.Info("Scale clamped by policy", "desired", c.Desired, "recommended", desired, "allowed", limited, "policy", policy)
+				desired, reason = limited, reason+", clamped by policy "+policy
+			}
+			if desired != c.Desired {
+				limiter.record(desired - c.Desired)
+			}
+		}
+		if desired != c.Desired {
+			moveASG(asg, drain, c, desired, asgEvent(asg, c, mq.Messages, code, reason))
+		} else {
+			log.Debug("No change", "messages", mq.Messages, "desired", c.Desired, "min", c.Min, "max", c.Max, "reason", reason)
+			monitorDecided(asg.AsGroupName, reason)
 		}
 
-		Info.Printf("ASG: %s, Current: %d, Min: %d, Max: %d\n", asg.AsGroupName, asgDesired, asgMin, asgMax)
 		time.Sleep(95 * time.Second)
 	}
 }
 
-func scaleUp(asg ASG) {
-	var d int
-	d = asgDesired + scaleUpBy
-	if d >= asgMax && asgDesired < asgMax {
-		scaleASG(asg, asgMax)
-	} else if d < asgMax {
-		scaleASG(asg, d)
-	} else {
-		Info.Printf("Workers Already Scaled up to Max\n")
+// asgControlled - Apply pause or override from the control API, true if handled.
+func asgControlled(asg ASG, drain *drainer, c asgCapacity, messages int) bool {
+	if monitorPaused(asg.AsGroupName) {
+		monitorDecided(asg.AsGroupName, "paused")
+		return true
+	}
+	if inhibitedDecision(asg.AsGroupName, asg.log()) {
+		return true
 	}
+	desired, ok := monitorOverride(asg.AsGroupName)
+	if !ok {
+		return false
+	}
+	if c.Desired != desired {
+		moveASG(asg, drain, c, desired, asgEvent(asg, c, messages, reasonOverride, "override"))
+	}
+	monitorDecided(asg.AsGroupName, fmt.Sprintf("override to %d", desired))
+	return true
 }
 
-func scaleDown(asg ASG) {
-	var d int
-	d = asgDesired - scaleDownBy
-	if d < asgMin && asgDesired > asgMin {
-		scaleASG(asg, asgMin)
-	} else if d >= asgMin {
-		scaleASG(asg, d)
-	} else {
-		Info.Printf("Workers Already Scaled to Min\n")
+// asgEvent - Event template for an action taken by an ASG monitor.
+func asgEvent(asg ASG, c asgCapacity, signal int, code string, reason string) Event {
+	return Event{
+		Monitor:     asg.AsGroupName,
+		ASG:         asg.AsGroupName,
+		Signal:      signal,
+		OldReplicas: c.Desired,
+		Reason:      reason,
+		ReasonCode:  code,
 	}
 }
 
 func amqScaleConnection(q ASG) *rabbithole.Client {
 	amqURL := os.Getenv(q.AmqHost)
 	if amqURL == "" {
-		Warning.Panic("Missing AMQ Environment Variable")
+		logger.Panic("Missing AMQ Environment Variable", "amqhost", q.AmqHost)
 	}
 	u, err := url.Parse(amqURL)
 	if err != nil {
-		Warning.Panic(err)
+		logger.Panic("Unable to Parse AMQ URL", "amqhost", q.AmqHost, "err", err)
 	}
 
 	password, _ := u.User.Password()
@@ -101,14 +202,12 @@ func amqScaleConnection(q ASG) *rabbithole.Client {
 	return rmqc
 }
 
-func getAutoScaleDesired(asg ASG) (int, int, int) {
-	var desired int
-	var min int
-	var max int
+func getAutoScaleDesired(asg ASG) (asgCapacity, error) {
+	var c asgCapacity
 
 	cfg, err := external.LoadDefaultAWSConfig()
 	if err != nil {
-		Warning.Panic("failed to load config, " + err.Error())
+		logger.Panic("Failed to load AWS config", "err", err)
 	}
 	cfg.Region = asg.AWSRegion
 
@@ -120,38 +219,47 @@ func getAutoScaleDesired(asg ASG) (int, int, int) {
 	}
 
 	req := svc.DescribeAutoScalingGroupsRequest(input)
+	start := time.Now()
 	result, err := req.Send()
+	externalCall("aws", asg.AWSRegion, "describe_asg", start, err)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
 			case autoscaling.ErrCodeInvalidNextToken:
-				Warning.Println(autoscaling.ErrCodeInvalidNextToken, aerr.Error())
+				asg.log().Error("Describe ASG failed", "code", autoscaling.ErrCodeInvalidNextToken, "err", aerr)
 			case autoscaling.ErrCodeResourceContentionFault:
-				Warning.Println(autoscaling.ErrCodeResourceContentionFault, aerr.Error())
+				asg.log().Error("Describe ASG failed", "code", autoscaling.ErrCodeResourceContentionFault, "err", aerr)
 			default:
-				Warning.Println(aerr.Error())
+				asg.log().Error("Describe ASG failed", "err", aerr)
 			}
 		} else {
 			// Print the error, cast err to awserr.Error to get the Code and
 			// Message from an error.
-			Warning.Println(err.Error())
+			asg.log().Error("Describe ASG failed", "err", err)
 		}
+		return c, err
 	}
 
 	for _, g := range result.AutoScalingGroups {
-		desired = int(*g.DesiredCapacity)
-		min = int(*g.MinSize)
-		max = int(*g.MaxSize)
+		c.Desired = int(*g.DesiredCapacity)
+		c.Min = int(*g.MinSize)
+		c.Max = int(*g.MaxSize)
+		c.Instances = g.Instances
 	}
-	return desired, min, max
+	return c, nil
 }
 
-func scaleASG(asg ASG, desired int) {
-	Info.Printf("I will scale ASG to: %d\n", desired)
+func scaleASG(asg ASG, desired int, e Event) {
+	e.Type = "asg_scale"
+	e.NewReplicas = desired
+	monitorDecided(asg.AsGroupName, fmt.Sprintf("scale to %d", desired))
+
+	log := asg.log()
+	log.Info("Scaling ASG", "from", e.OldReplicas, "desired", desired, "reason", e.Reason)
 
 	cfg, err := external.LoadDefaultAWSConfig()
 	if err != nil {
-		Warning.Panic("failed to load config, " + err.Error())
+		logger.Panic("Failed to load AWS config", "err", err)
 	}
 	cfg.Region = asg.AWSRegion
 
@@ -170,16 +278,18 @@ func scaleASG(asg ASG, desired int) {
 		HonorCooldown:        &coolDown,
 	}
 
-	if asg.Enabled {
+	if asgDryRun(asg.AsGroupName, e.Monitor) {
+		recordEvent(e, true, nil)
+		log.Info("Dry run, not scaling", "desired", desired)
+	} else {
 		promASGscale.With(prometheus.Labels{"name": asg.AsGroupName}).Inc()
 		req := svc.SetDesiredCapacityRequest(input)
+		start := time.Now()
 		resp, err := req.Send()
+		externalCall("aws", asg.AWSRegion, "set_desired_capacity", start, err)
+		recordEvent(e, false, err)
 		if err != nil {
-			Info.Println("Scaling Failed, Cooldown window may be active")
-			Info.Println(resp)
+			log.Error("Scaling Failed, Cooldown window may be active", "err", err, "response", resp)
 		}
-
-	} else {
-		Info.Println("Scaling is disabled: envvar Enabled: True to enable")
 	}
 }
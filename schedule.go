@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule Time window changing a monitor's replica limits
+//
+// The window opens whenever Start (a 5 field cron expression: minute hour
+// day-of-month month day-of-week) matches in Timezone, and stays open for
+// Duration minutes. Unset fields leave the monitor's own limits in place.
+type Schedule struct {
+	Name     string
+	Start    string
+	Duration int
+	Timezone string
+	Min      *int
+	Max      *int
+	// Pin replicas to this count while the window is open
+	Replicas *int
+}
+
+// Limits Effective replica limits of a monitor at a point in time
+type Limits struct {
+	Min      int
+	Max      int
+	Pinned   bool
+	Replicas int
+	Schedule string
+}
+
+// cronField Allowed values of one cron field
+type cronField map[int]bool
+
+// cronSpec Parsed 5 field cron expression
+type cronSpec struct {
+	minute, hour, dom, month, dow cronField
+	domAny, dowAny                bool
+}
+
+// parseCronField - Values allowed by a field of lists, ranges and steps within lo..hi.
+func parseCronField(s string, lo int, hi int) (cronField, error) {
+	f := cronField{}
+	for _, part := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			step, part = n, part[:i]
+		}
+		from, to := lo, hi
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			n, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			from, to = n, n
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid range %q", part)
+				}
+			} else if step > 1 {
+				to = hi
+			}
+		}
+		if from < lo || to > hi || from > to {
+			return nil, fmt.Errorf("%q out of range %d-%d", part, lo, hi)
+		}
+		for v := from; v <= to; v += step {
+			f[v] = true
+		}
+	}
+	return f, nil
+}
+
+func parseCron(expr string) (cronSpec, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return cronSpec{}, fmt.Errorf("cron expression %q needs 5 fields", expr)
+	}
+	var c cronSpec
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return c, err
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return c, err
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return c, err
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return c, err
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return c, err
+	}
+	// 7 is Sunday too
+	if c.dow[7] {
+		c.dow[0] = true
+	}
+	c.domAny, c.dowAny = fields[2] == "*", fields[4] == "*"
+	return c, nil
+}
+
+// matches - Whether t, truncated to the minute, is a start time of the expression.
+func (c cronSpec) matches(t time.Time) bool {
+	if !c.minute[t.Minute()] || !c.hour[t.Hour()] || !c.month[int(t.Month())] {
+		return false
+	}
+	// Like cron, day-of-month and day-of-week are OR'd when both are restricted
+	dom, dow := c.dom[t.Day()], c.dow[int(t.Weekday())]
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	}
+	return dom || dow
+}
+
+// compiledSchedule Schedule with its cron expression and timezone resolved
+type compiledSchedule struct {
+	Schedule
+	cron cronSpec
+	loc  *time.Location
+}
+
+// compileSchedules - Parse the schedules of a monitor, panicking on invalid config.
+func compileSchedules(monitor string, schedules []Schedule) []compiledSchedule {
+	var out []compiledSchedule
+	for i, s := range schedules {
+		if s.Name == "" {
+			s.Name = fmt.Sprintf("schedule-%d", i)
+		}
+		cron, err := parseCron(s.Start)
+		if err != nil {
+			logger.Panic("Invalid schedule", "monitor", monitor, "schedule", s.Name, "err", err)
+		}
+		loc := time.UTC
+		if s.Timezone != "" {
+			if loc, err = time.LoadLocation(s.Timezone); err != nil {
+				logger.Panic("Invalid schedule timezone", "monitor", monitor, "schedule", s.Name, "err", err)
+			}
+		}
+		if s.Duration <= 0 {
+			logger.Panic("Invalid schedule duration", "monitor", monitor, "schedule", s.Name)
+		}
+		out = append(out, compiledSchedule{Schedule: s, cron: cron, loc: loc})
+	}
+	return out
+}
+
+// active - Whether the window is open at t, started within the last Duration minutes.
+func (s compiledSchedule) active(t time.Time) bool {
+	t = t.In(s.loc).Truncate(time.Minute)
+	for i := 0; i < s.Duration; i++ {
+		if s.cron.matches(t.Add(-time.Duration(i) * time.Minute)) {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduledLimits - Limits at t: base, changed by every open window, later schedules winning.
+func scheduledLimits(schedules []compiledSchedule, base Limits, t time.Time) Limits {
+	lim := base
+	for _, s := range schedules {
+		if !s.active(t) {
+			continue
+		}
+		lim.Schedule = s.Name
+		if s.Min != nil {
+			lim.Min = *s.Min
+		}
+		if s.Max != nil {
+			lim.Max = *s.Max
+		}
+		if s.Replicas != nil {
+			lim.Pinned, lim.Replicas = true, *s.Replicas
+		}
+	}
+	return lim
+}
+
+func (l Limits) String() string {
+	if l.Pinned {
+		return fmt.Sprintf("pinned=%d", l.Replicas)
+	}
+	return fmt.Sprintf("min=%d max=%d", l.Min, l.Max)
+}
+
+// previewSchedules - Write each monitor's effective limits over the next 24 hours.
+//
+// ASG limits are relative to the group's own min/max, unknown here, so only
+// scheduled values are shown for them.
+func previewSchedules(w io.Writer, from time.Time) {
+	type monitor struct {
+		name      string
+		asg       bool
+		base      Limits
+		schedules []compiledSchedule
+	}
+	var monitors []monitor
+	for _, q := range cfg.Queues {
+		monitors = append(monitors, monitor{q.monitorName(), false, Limits{Min: q.ScaleMin, Max: q.ScaleMax}, compileSchedules(q.monitorName(), q.Schedules)})
+	}
+	for _, asg := range cfg.ASG {
+		monitors = append(monitors, monitor{asg.AsGroupName, true, Limits{}, compileSchedules(asg.AsGroupName, asg.Schedules)})
+	}
+
+	from = from.Truncate(time.Minute)
+	for _, m := range monitors {
+		fmt.Fprintln(w, m.name)
+		var last Limits
+		for i := 0; i <= 24*60; i++ {
+			t := from.Add(time.Duration(i) * time.Minute)
+			lim := scheduledLimits(m.schedules, m.base, t)
+			if i > 0 && lim == last {
+				continue
+			}
+			last = lim
+			source, limits := lim.Schedule, lim.String()
+			if source == "" {
+				source = "default"
+				if m.asg {
+					limits = "group min/max"
+				}
+			}
+			fmt.Fprintf(w, "\t%s\t%s\t(%s)\n", t.Format("2006-01-02 15:04 MST"), limits, source)
+		}
+	}
+}
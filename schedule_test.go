@@ -0,0 +1,93 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCronField(t *testing.T) {
+	tests := []struct {
+		in      string
+		lo, hi  int
+		want    []int
+		invalid bool
+	}{
+		{in: "*", lo: 0, hi: 6, want: []int{0, 1, 2, 3, 4, 5, 6}},
+		{in: "5", lo: 0, hi: 59, want: []int{5}},
+		{in: "1,3,5", lo: 0, hi: 6, want: []int{1, 3, 5}},
+		{in: "9-12", lo: 0, hi: 23, want: []int{9, 10, 11, 12}},
+		{in: "*/15", lo: 0, hi: 59, want: []int{0, 15, 30, 45}},
+		{in: "10-20/5", lo: 0, hi: 59, want: []int{10, 15, 20}},
+		{in: "50/5", lo: 0, hi: 59, want: []int{50, 55}},
+		{in: "1-2,5", lo: 1, hi: 12, want: []int{1, 2, 5}},
+		{in: "60", lo: 0, hi: 59, invalid: true},
+		{in: "0", lo: 1, hi: 31, invalid: true},
+		{in: "5-3", lo: 0, hi: 59, invalid: true},
+		{in: "*/0", lo: 0, hi: 59, invalid: true},
+		{in: "a", lo: 0, hi: 59, invalid: true},
+		{in: "1-x", lo: 0, hi: 59, invalid: true},
+		{in: "", lo: 0, hi: 59, invalid: true},
+	}
+	for _, tt := range tests {
+		f, err := parseCronField(tt.in, tt.lo, tt.hi)
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("parseCronField(%q) = %v, want error", tt.in, f)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCronField(%q): %v", tt.in, err)
+			continue
+		}
+		want := cronField{}
+		for _, v := range tt.want {
+			want[v] = true
+		}
+		if !reflect.DeepEqual(f, want) {
+			t.Errorf("parseCronField(%q) = %v, want %v", tt.in, f, want)
+		}
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "* * * * * *", "* 24 * * *", "* * * 13 *", "* * * * 8"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) should fail", expr)
+		}
+	}
+}
+
+func TestCronMatches(t *testing.T) {
+	// Monday 2 March 2020
+	monday := time.Date(2020, time.March, 2, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		expr string
+		at   time.Time
+		want bool
+	}{
+		{"0 9 * * *", monday, true},
+		{"0 9 * * *", monday.Add(time.Minute), false},
+		{"0 9 * * 1-5", monday, true},
+		{"0 9 * * 0", monday, false},
+		{"0 9 * * 7", monday.AddDate(0, 0, 6), true},
+		{"0 9 2 * *", monday, true},
+		{"0 9 2 4 *", monday, false},
+		// Restricted day-of-month and day-of-week are OR'd
+		{"0 9 15 * 1", monday, true},
+		{"0 9 2 * 0", monday, true},
+		{"0 9 15 * 0", monday, false},
+		{"*/30 8-10 * * *", monday.Add(30 * time.Minute), true},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := c.matches(tt.at); got != tt.want {
+			t.Errorf("%q matches %s = %t, want %t", tt.expr, tt.at.Format(time.RFC1123), got, tt.want)
+		}
+	}
+}
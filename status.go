@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MonitorStatus Live state of a single Queue, Alert or ASG monitor
+type MonitorStatus struct {
+	Name         string         `json:"name"`
+	Type         string         `json:"type"`
+	Method       string         `json:"method"`
+	App          string         `json:"app,omitempty"`
+	Worker       string         `json:"worker,omitempty"`
+	ASG          string         `json:"asg,omitempty"`
+	Queue        string         `json:"queue,omitempty"`
+	Source       string         `json:"source"`
+	Threshold    int            `json:"threshold,omitempty"`
+	Watermark    int            `json:"watermark,omitempty"`
+	Min          int            `json:"min,omitempty"`
+	Max          int            `json:"max,omitempty"`
+	Depth        int            `json:"depth"`
+	Replicas     int            `json:"replicas"`
+	LastPoll     time.Time      `json:"last_poll"`
+	LastDecision string         `json:"last_decision"`
+	LastError    string         `json:"last_error,omitempty"`
+	Healthy      bool           `json:"healthy"`
+	Control      MonitorControl `json:"control"`
+	Inhibited    []string       `json:"inhibited,omitempty"`
+	// Without a poll for this long the monitor is stale, at least monitorStaleAfter
+	StaleAfter time.Duration `json:"-"`
+}
+
+// Status Response body for the status API
+type Status struct {
+	Enabled  bool            `json:"enabled"`
+	Monitors []MonitorStatus `json:"monitors"`
+	Inhibits []InhibitStatus `json:"inhibits"`
+}
+
+// A monitor which hasn't polled in this long is reported unhealthy
+const monitorStaleAfter = 5 * time.Minute
+
+// staleAfter - Stale-after window of a monitor polling every interval, three missed polls.
+func staleAfter(interval time.Duration) time.Duration {
+	if 3*interval > monitorStaleAfter {
+		return 3 * interval
+	}
+	return monitorStaleAfter
+}
+
+// stale - Whether the monitor's last poll is older than its stale-after window.
+func (s MonitorStatus) stale() bool {
+	after := s.StaleAfter
+	if after < monitorStaleAfter {
+		after = monitorStaleAfter
+	}
+	return time.Since(s.LastPoll) >= after
+}
+
+var (
+	statusMu    sync.Mutex
+	statusOrder []string
+	statusBoard = map[string]*MonitorStatus{}
+)
+
+// registerMonitor - Add a monitor to the status board with its static config.
+func registerMonitor(s MonitorStatus) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	if _, ok := statusBoard[s.Name]; !ok {
+		statusOrder = append(statusOrder, s.Name)
+	}
+	statusBoard[s.Name] = &s
+	if s.Type == "queue" || s.Type == "asg" {
+		promThreshold.With(prometheus.Labels{"monitor": s.Name}).Set(float64(s.Threshold))
+		promWatermark.With(prometheus.Labels{"monitor": s.Name}).Set(float64(s.Watermark))
+		promReplicasMin.With(prometheus.Labels{"monitor": s.Name}).Set(float64(s.Min))
+		promReplicasMax.With(prometheus.Labels{"monitor": s.Name}).Set(float64(s.Max))
+	}
+}
+
+// updateMonitor - Apply fn to a registered monitor's live state.
+func updateMonitor(name string, fn func(*MonitorStatus)) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	if s, ok := statusBoard[name]; ok {
+		fn(s)
+	}
+}
+
+// monitorRegistered - Whether name is a monitor on the status board.
+func monitorRegistered(name string) bool {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	_, ok := statusBoard[name]
+	return ok
+}
+
+// monitorPolled - Record the outcome of one poll of a monitor's signal.
+func monitorPolled(name string, depth int, replicas int, err error) {
+	updateMonitor(name, func(s *MonitorStatus) {
+		s.LastPoll = time.Now()
+		if err != nil {
+			s.LastError = err.Error()
+			return
+		}
+		s.LastError = ""
+		s.Depth = depth
+		s.Replicas = replicas
+		if s.Type == "queue" || s.Type == "asg" {
+			promQueueDepth.With(prometheus.Labels{"monitor": name, "queue": s.Queue}).Set(float64(depth))
+		}
+		if (s.Type == "queue" || s.Type == "asg") && s.Method != "restart" {
+			promReplicasCurrent.With(prometheus.Labels{"monitor": name}).Set(float64(replicas))
+			promReplicasMin.With(prometheus.Labels{"monitor": name}).Set(float64(s.Min))
+			promReplicasMax.With(prometheus.Labels{"monitor": name}).Set(float64(s.Max))
+		}
+	})
+}
+
+// monitorDecided - Record the last decision a monitor made.
+func monitorDecided(name string, decision string) {
+	updateMonitor(name, func(s *MonitorStatus) {
+		s.LastDecision = decision
+	})
+}
+
+// statusSnapshot - Copy of every monitor's state, in config order.
+func statusSnapshot() Status {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	st := Status{Enabled: actionsEnabled(), Monitors: []MonitorStatus{}, Inhibits: inhibitSnapshot()}
+	for _, name := range statusOrder {
+		s := *statusBoard[name]
+		// Webhook-only Alert monitors are not polled, so can't go stale
+		s.Healthy = s.LastError == "" && (s.Source == "webhook" || !s.stale())
+		s.Control = monitorControl(name)
+		s.Inhibited = monitorInhibited(name)
+		st.Monitors = append(st.Monitors, s)
+	}
+	return st
+}
+
+// StatusAPI Live status of every monitor as JSON
+func StatusAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, statusSnapshot())
+}
+
+// Index Print Status of Service
+func Index(w http.ResponseWriter, r *http.Request) {
+	st := statusSnapshot()
+	fmt.Fprintln(w, "Enabled: ", st.Enabled)
+	for _, m := range st.Monitors {
+		fmt.Fprintf(w, "%s (%s)\n", m.Name, m.Type)
+		fmt.Fprintln(w, "\tMethod: ", m.Method)
+		if m.Queue != "" {
+			fmt.Fprintln(w, "\tqueue: ", m.Queue)
+		}
+		fmt.Fprintln(w, "\tSource: ", m.Source)
+		if m.Type == "queue" || m.Type == "asg" {
+			fmt.Fprintln(w, "\tThreshold: ", m.Threshold)
+			fmt.Fprintln(w, "\tWatermark: ", m.Watermark)
+			fmt.Fprintln(w, "\tMin/Max: ", m.Min, m.Max)
+			fmt.Fprintln(w, "\tDepth: ", m.Depth)
+			fmt.Fprintln(w, "\tReplicas: ", m.Replicas)
+		}
+		fmt.Fprintln(w, "\tLast Poll: ", m.LastPoll.Format(time.RFC3339))
+		fmt.Fprintln(w, "\tLast Decision: ", m.LastDecision)
+		if m.LastError != "" {
+			fmt.Fprintln(w, "\tLast Error: ", m.LastError)
+		}
+		fmt.Fprintln(w, "\tHealthy: ", m.Healthy)
+		if m.Control.Paused {
+			fmt.Fprintln(w, "\tPaused")
+		}
+		if m.Control.DryRun {
+			fmt.Fprintln(w, "\tDry Run")
+		}
+		if o := m.Control.Override; o != nil {
+			fmt.Fprintf(w, "\tOverride: %d until %s\n", o.Replicas, o.Until.Format(time.RFC3339))
+		}
+		if len(m.Inhibited) > 0 {
+			fmt.Fprintln(w, "\tInhibited by: ", strings.Join(m.Inhibited, ", "))
+		}
+	}
+}